@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+var (
+	dist = flag.String("dist", "uniform", "distribution of the load test amounts, uniform below 100 points, "+
+		"fixed at -dist-amount or lognormal with median -dist-amount and -dist-sigma")
+	distAmount = flag.Float64("dist-amount", 50, "amount of the fixed distribution and median of the lognormal distribution, in points")
+	distSigma  = flag.Float64("dist-sigma", 1, "sigma of the lognormal distribution, larger values give a longer tail of big amounts")
+)
+
+// amountGen returns the amount of the next load test op from rnd,
+// whole points unless amounts are numeric.
+type amountGen func(rnd *rand.Rand) Points
+
+// genAmount is the amount generator of the load workers, set by main from -dist
+var genAmount amountGen = randomPoints
+
+// parseAmountDist returns the generator of the -dist name.
+func parseAmountDist(name string) (amountGen, error) {
+	switch name {
+	case "uniform":
+		return randomPoints, nil
+	case "fixed":
+		amount := roundPoints(*distAmount)
+		return func(*rand.Rand) Points {
+			return amount
+		}, nil
+	case "lognormal":
+		if *distAmount <= 0 {
+			return nil, fmt.Errorf("lognormal distribution requires a positive -dist-amount, got %g", *distAmount)
+		}
+		mu := math.Log(*distAmount)
+		return func(rnd *rand.Rand) Points {
+			return roundPoints(math.Exp(mu + *distSigma*rnd.NormFloat64()))
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown amount distribution %q", name)
+	}
+}
+
+// randomPoints returns a uniformly random amount below 100 points.
+func randomPoints(rnd *rand.Rand) Points {
+	if *amountType == "numeric" {
+		return Points(rnd.Int63n(int64(100 * pointsScale)))
+	}
+	return Points(rnd.Int63n(100)) * pointsScale
+}
+
+// roundPoints rounds the amount in points to the precision of -amount-type.
+func roundPoints(amount float64) Points {
+	if *amountType == "numeric" {
+		return Points(math.Round(amount * float64(pointsScale)))
+	}
+	return Points(math.Round(amount)) * pointsScale
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+)
+
+var backpressure = flag.String("backpressure", "block", "what a batch op does when its batcher queue is full, "+
+	"block waits for room, error fails the op and drop-oldest fails the oldest queued op to make room")
+
+// errSystemBusy fails an op shed because its batcher queue is full.
+var errSystemBusy = errors.New("system busy")
+
+// BackpressurePolicy is what Submit does when the batcher queue is full.
+type BackpressurePolicy int
+
+const (
+	// BackpressureBlock waits for room in the queue or for the caller's ctx to be done.
+	BackpressureBlock BackpressurePolicy = iota
+
+	// BackpressureError fails the submitted op with errSystemBusy right away.
+	BackpressureError
+
+	// BackpressureDropOldest fails the oldest queued op with errSystemBusy and queues the submitted op in its place.
+	BackpressureDropOldest
+)
+
+// backpressurePolicy is the policy of new batchers, set by main from -backpressure
+var backpressurePolicy BackpressurePolicy
+
+// parseBackpressurePolicy returns the policy for the -backpressure name.
+func parseBackpressurePolicy(name string) (BackpressurePolicy, error) {
+	switch name {
+	case "block":
+		return BackpressureBlock, nil
+	case "error":
+		return BackpressureError, nil
+	case "drop-oldest":
+		return BackpressureDropOldest, nil
+	default:
+		return 0, fmt.Errorf("unknown backpressure policy %q", name)
+	}
+}
+
+// submitDropOldest queues p, failing the oldest ops of ops until there is room.
+func submitDropOldest(ops chan op, p op) {
+	for {
+		select {
+		case ops <- p:
+			return
+		default:
+		}
+
+		// the Run loop may have taken the oldest op meanwhile, then there is room on the next try
+		select {
+		case old := <-ops:
+			shedOps.Inc()
+			old.done <- callback{err: errSystemBusy}
+		default:
+		}
+	}
+}
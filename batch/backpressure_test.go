@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// saturatedBatcher returns a batcher of the policy without a Run loop, its queue filled with ops of a and b.
+func saturatedBatcher(t *testing.T, policy BackpressurePolicy) (*Batcher, []<-chan callback) {
+	t.Helper()
+	b := NewBatcher(nil, BatcherOptions{FlushSize: 10, QueueSize: 2, Backpressure: policy})
+	queued := []<-chan callback{submitOp(t, b, "a"), submitOp(t, b, "b")}
+	return b, queued
+}
+
+func TestBackpressureBlock(t *testing.T) {
+	b, _ := saturatedBatcher(t, BackpressureBlock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := b.Submit(ctx, op{userID: "c", done: make(chan callback, 1)})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want %v after waiting for room", err, context.DeadlineExceeded)
+	}
+	if len(b.ops) != 2 {
+		t.Errorf("%d ops queued, want 2", len(b.ops))
+	}
+}
+
+func TestBackpressureError(t *testing.T) {
+	b, queued := saturatedBatcher(t, BackpressureError)
+
+	err := b.Submit(context.Background(), op{userID: "c", done: make(chan callback, 1)})
+	if !errors.Is(err, errSystemBusy) {
+		t.Fatalf("got error %v, want %v", err, errSystemBusy)
+	}
+	for i, d := range queued {
+		select {
+		case cb := <-d:
+			t.Errorf("queued op %d failed with %+v", i, cb)
+		default:
+		}
+	}
+}
+
+func TestBackpressureDropOldest(t *testing.T) {
+	b, queued := saturatedBatcher(t, BackpressureDropOldest)
+
+	submitOp(t, b, "c")
+	select {
+	case cb := <-queued[0]:
+		if !errors.Is(cb.err, errSystemBusy) {
+			t.Errorf("oldest op: got %+v, want error %v", cb, errSystemBusy)
+		}
+	default:
+		t.Fatal("oldest op not dropped")
+	}
+
+	var userIDs []string
+	for len(b.ops) > 0 {
+		userIDs = append(userIDs, (<-b.ops).userID)
+	}
+	if len(userIDs) != 2 || userIDs[0] != "b" || userIDs[1] != "c" {
+		t.Errorf("queued %v, want [b c]", userIDs)
+	}
+}
+
+func TestParseBackpressurePolicy(t *testing.T) {
+	for name, want := range map[string]BackpressurePolicy{
+		"block":       BackpressureBlock,
+		"error":       BackpressureError,
+		"drop-oldest": BackpressureDropOldest,
+	} {
+		got, err := parseBackpressurePolicy(name)
+		if err != nil || got != want {
+			t.Errorf("parseBackpressurePolicy(%q) = %v, %v, want %v", name, got, err, want)
+		}
+	}
+	if _, err := parseBackpressurePolicy("drop"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"hash/fnv"
+	"sync"
+)
+
+var balanceCacheEnabled = flag.Bool("balance-cache", false, "cache the user balances served at /balance of -debug-addr in memory, kept fresh by add point and the batch flush")
+
+// balanceCache caches user balances, sharded by user id to spread lock contention.
+var balanceCache [16]balanceCacheShard
+
+type balanceCacheShard struct {
+	mu sync.RWMutex
+	m  map[string]Points
+
+	// gen is bumped by every write, a load only caches its result
+	// when no write happened while it was reading the db
+	gen uint64
+}
+
+func balanceCacheShardOf(userID string) *balanceCacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return &balanceCache[h.Sum32()%uint32(len(balanceCache))]
+}
+
+// getBalanceCached returns the balance of the user, loading it on a cache miss.
+// A user without a balance has 0.
+func getBalanceCached(ctx context.Context, userID string) (Points, error) {
+	if !*balanceCacheEnabled {
+		return loadBalance(ctx, userID)
+	}
+
+	s := balanceCacheShardOf(userID)
+	s.mu.RLock()
+	balance, ok := s.m[userID]
+	gen := s.gen
+	s.mu.RUnlock()
+	if ok {
+		return balance, nil
+	}
+
+	balance, err := loadBalance(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	if s.gen == gen {
+		if s.m == nil {
+			s.m = make(map[string]Points)
+		}
+		s.m[userID] = balance
+	}
+	s.mu.Unlock()
+	return balance, nil
+}
+
+func loadBalance(ctx context.Context, userID string) (Points, error) {
+	balance, _, err := pointsRepo.Balance(ctx, userID)
+	return balance, err
+}
+
+// setCachedBalance stores a committed balance,
+// only writers that commit in order for a user may use it.
+func setCachedBalance(userID string, balance Points) {
+	if !*balanceCacheEnabled {
+		return
+	}
+
+	s := balanceCacheShardOf(userID)
+	s.mu.Lock()
+	s.gen++
+	if s.m == nil {
+		s.m = make(map[string]Points)
+	}
+	s.m[userID] = balance
+	s.mu.Unlock()
+}
+
+// invalidateCachedBalance evicts the balance of the user,
+// used by writers whose commits may land out of order.
+func invalidateCachedBalance(userID string) {
+	if !*balanceCacheEnabled {
+		return
+	}
+
+	s := balanceCacheShardOf(userID)
+	s.mu.Lock()
+	s.gen++
+	delete(s.m, userID)
+	s.mu.Unlock()
+}
+
+// resetBalanceCache drops every cached balance, e.g. after truncating user_points.
+func resetBalanceCache() {
+	for i := range balanceCache {
+		s := &balanceCache[i]
+		s.mu.Lock()
+		s.gen++
+		s.m = nil
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// enableBalanceCache turns the balance cache on, empty, until the test ends.
+func enableBalanceCache(t *testing.T) {
+	t.Helper()
+	setFlag(t, "balance-cache", "true")
+	resetBalanceCache()
+	t.Cleanup(resetBalanceCache)
+}
+
+func TestBalanceCacheBatchFlush(t *testing.T) {
+	enableBalanceCache(t)
+
+	// a balance cached before the write, a read after the flush must not return it
+	setCachedBalance("a", 50)
+	store := newMemStore(map[string]Points{"a": 50})
+	ops := []op{{userID: "a", amount: 10}, {userID: "b", amount: 7}, {userID: "a", amount: -100}}
+	err := newPointFlush(store)(context.Background(), ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every dirty user is cached, the reads hit the cache without a db in ctx
+	for userID, want := range map[string]Points{"a": 60, "b": 7} {
+		balance, err := getBalanceCached(context.Background(), userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance != want {
+			t.Errorf("cached balance of %s = %v, want %v", userID, balance, want)
+		}
+	}
+}
+
+func TestBalanceCacheInvalidate(t *testing.T) {
+	enableBalanceCache(t)
+
+	setCachedBalance("a", 50)
+	invalidateCachedBalance("a")
+	s := balanceCacheShardOf("a")
+	s.mu.RLock()
+	_, ok := s.m["a"]
+	s.mu.RUnlock()
+	if ok {
+		t.Error("balance still cached after invalidation")
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// batch flush size
+var (
+	minFlushSize = flag.Int("min-flush-size", 0, "smallest batch flushed early while the queue is shallow, 0 disables adaptive sizing")
+	maxFlushSize = flag.Int("max-flush-size", 7000, "number of buffered ops that always triggers a flush")
+
+	flushTimeout = flag.Duration("flush-timeout", 5*time.Second, "maximum time of a single batch flush, "+
+		"a hung flush fails its ops with the timeout instead of stalling the batcher")
+
+	commitBatchSize = flag.Int("commit-batch-size", 0, "commit a batch flush in transactions of at most this many ops, "+
+		"balances are restored once per flush; 0 commits the whole batch in one transaction")
+)
+
+// ErrBatcherClosed fails an op submitted after the batcher is closed.
+var ErrBatcherClosed = errors.New("batcher closed")
+
+// flushFunc applies a batch of ops and sets the result of each op.
+// An error fails every op in the batch.
+type flushFunc func(ctx context.Context, ops []op) error
+
+// BatcherOptions configures a Batcher.
+type BatcherOptions struct {
+	// FlushInterval is the time between timer flushes,
+	// 0 flushes only when the buffer is full or after flushFallbackInterval.
+	FlushInterval time.Duration
+
+	// FlushSize is the number of buffered ops that triggers a flush.
+	FlushSize int
+
+	// MinFlushSize enables adaptive sizing when positive,
+	// the buffer is flushed once it holds as many ops as are queued behind it
+	// but at least MinFlushSize, so a shallow queue flushes small batches early
+	// and a deep queue accumulates up to FlushSize.
+	MinFlushSize int
+
+	// QueueSize is the number of submitted ops waiting for the Run loop on each lane.
+	QueueSize int
+
+	// FlushTimeout bounds a flush so a hung transaction fails its callers instead of stalling the Run loop,
+	// 0 does not bound it.
+	FlushTimeout time.Duration
+
+	// Backpressure is what Submit does when the queue is full.
+	Backpressure BackpressurePolicy
+
+	// OnFlush is called after every flush when not nil,
+	// it runs on the Run loop so a slow callback delays the next flush.
+	OnFlush func(FlushStats)
+
+	// clock drives the timer flush and times the flushes, nil is the real clock
+	clock clock
+}
+
+// Batcher buffers submitted ops and flushes them in batches from a single Run loop.
+type Batcher struct {
+	opts        BatcherOptions
+	flush       flushFunc
+	ops         chan op
+	priorityOps chan op
+
+	// priorityBuff is the batch of a priority flush, reused by the Run loop
+	priorityBuff []op
+
+	// mu is held for reading by Submit while it queues an op,
+	// Close takes it for writing so no op is queued after the Run loop drains
+	mu     sync.RWMutex
+	closed bool
+
+	// closing wakes the Submits waiting for room, stopped tells the Run loop to drain
+	closing   chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewBatcher creates a batcher that flushes with flush.
+func NewBatcher(flush flushFunc, opts BatcherOptions) *Batcher {
+	if opts.clock == nil {
+		opts.clock = realClock{}
+	}
+	return &Batcher{
+		opts:        opts,
+		flush:       flush,
+		ops:         make(chan op, opts.QueueSize),
+		priorityOps: make(chan op, opts.QueueSize),
+		closing:     make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+}
+
+// Close stops accepting ops, a later Submit fails with ErrBatcherClosed.
+// The Run loop drains the queued ops and returns, Close does not wait for it.
+func (b *Batcher) Close() {
+	b.closeOnce.Do(func() {
+		close(b.closing)
+		b.mu.Lock()
+		b.closed = true
+		b.mu.Unlock()
+		close(b.stopped)
+	})
+}
+
+// Submit queues p for the next flush, the result is sent to p.done.
+// A priority op is flushed as soon as the Run loop receives it.
+// A full queue is handled by the Backpressure option, the priority lane is full on its own.
+func (b *Batcher) Submit(ctx context.Context, p op) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrBatcherClosed
+	}
+
+	ops := b.ops
+	if p.priority {
+		ops = b.priorityOps
+	}
+
+	switch b.opts.Backpressure {
+	case BackpressureError:
+		select {
+		case ops <- p:
+			return nil
+		default:
+			shedOps.Inc()
+			return errSystemBusy
+		}
+	case BackpressureDropOldest:
+		submitDropOldest(ops, p)
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-b.closing:
+		return ErrBatcherClosed
+	case ops <- p:
+		return nil
+	}
+}
+
+// Run buffers and flushes ops until ctx is done or the batcher is closed,
+// then drains the buffered and queued ops. A done ctx closes the batcher.
+func (b *Batcher) Run(ctx context.Context) {
+	buff := make([]op, 0, b.opts.FlushSize)
+
+	interval := b.opts.FlushInterval
+	if interval <= 0 {
+		interval = flushFallbackInterval
+	}
+
+	// a ticker keeps firing under a steady stream of ops,
+	// a timer created per loop iteration would be reset by every op and never fire
+	ticker := b.opts.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// select picks a ready case at random, check the priority lane first
+		select {
+		case p := <-b.priorityOps:
+			buff = b.flushPriority(ctx, buff, p)
+			continue
+		default:
+		}
+
+		select {
+		case <-ctx.Done():
+			b.Close()
+			// ctx is done, flush on a ctx that is not so the drain can still commit
+			b.drain(context.WithoutCancel(ctx), buff)
+			return
+		case <-b.stopped:
+			b.drain(ctx, buff)
+			return
+		case <-ticker.C():
+			b.flushBuffer(ctx, buff, "timer")
+			buff = buff[:0]
+		case p := <-b.priorityOps:
+			buff = b.flushPriority(ctx, buff, p)
+		case p := <-b.ops:
+			buff = append(buff, p)
+			bufferedOps.Inc()
+			switch {
+			case len(buff) >= b.opts.FlushSize:
+				b.flushBuffer(ctx, buff, "full")
+				buff = buff[:0]
+			case len(buff) >= b.adaptiveFlushSize():
+				b.flushBuffer(ctx, buff, "adaptive")
+				buff = buff[:0]
+			}
+		}
+	}
+}
+
+// flushPriority flushes p right away with the other queued priority ops.
+// The buffered and queued ops of their users go first in the same flush,
+// so the ops a user submitted before p are applied before it;
+// the ops of other users stay buffered for the next flush.
+func (b *Batcher) flushPriority(ctx context.Context, buff []op, p op) []op {
+	prio := []op{p}
+	for n := len(b.priorityOps); n > 0; n-- {
+		prio = append(prio, <-b.priorityOps)
+	}
+	bufferedOps.Add(float64(len(prio)))
+	for n := len(b.ops); n > 0; n-- {
+		buff = append(buff, <-b.ops)
+		bufferedOps.Inc()
+	}
+
+	users := make(map[string]bool, len(prio))
+	for _, q := range prio {
+		users[q.userID] = true
+	}
+	batch := b.priorityBuff[:0]
+	rest := buff[:0]
+	for _, q := range buff {
+		if users[q.userID] {
+			batch = append(batch, q)
+		} else {
+			rest = append(rest, q)
+		}
+	}
+	batch = append(batch, prio...)
+	b.flushBuffer(ctx, batch, "priority")
+	// the ops are delivered, drop them so the reused slice does not keep their ctx alive
+	clear(batch)
+	b.priorityBuff = batch[:0]
+
+	buff = rest
+	for len(buff) >= b.opts.FlushSize {
+		b.flushBuffer(ctx, buff[:b.opts.FlushSize], "full")
+		buff = append(buff[:0], buff[b.opts.FlushSize:]...)
+	}
+	return buff
+}
+
+// drain flushes buff and the ops queued on both lanes, so their callers get a result
+// instead of waiting forever on a stopped Run loop.
+// The normal lane goes first as in flushPriority.
+func (b *Batcher) drain(ctx context.Context, buff []op) {
+	for _, ops := range []chan op{b.ops, b.priorityOps} {
+		for n := len(ops); n > 0; n-- {
+			buff = append(buff, <-ops)
+			bufferedOps.Inc()
+			if len(buff) >= b.opts.FlushSize {
+				b.flushBuffer(ctx, buff, "drain")
+				buff = buff[:0]
+			}
+		}
+	}
+	b.flushBuffer(ctx, buff, "drain")
+}
+
+// adaptiveFlushSize returns the buffer size that triggers an early flush for the current queue depth.
+func (b *Batcher) adaptiveFlushSize() int {
+	if b.opts.MinFlushSize <= 0 {
+		return b.opts.FlushSize
+	}
+	return min(max(len(b.ops), b.opts.MinFlushSize), b.opts.FlushSize)
+}
+
+// flushBuffer flushes buff, reason is why the flush was triggered.
+func (b *Batcher) flushBuffer(ctx context.Context, buff []op, reason string) {
+	bufferedOps.Sub(float64(len(buff)))
+	buff = skipCanceledOps(buff)
+	if len(buff) == 0 {
+		return
+	}
+	flushes.WithLabelValues(reason).Inc()
+
+	ctx, span := tracer.Start(ctx, "flush", trace.WithAttributes(
+		attribute.Int("batch_size", len(buff)),
+		attribute.String("reason", reason),
+	), trace.WithLinks(opLinks(buff)...))
+
+	fctx := ctx
+	if b.opts.FlushTimeout > 0 {
+		var cancel context.CancelFunc
+		fctx, cancel = context.WithTimeout(ctx, b.opts.FlushTimeout)
+		defer cancel()
+	}
+
+	start := b.opts.clock.Now()
+	err := b.flush(fctx, buff)
+	elapsed := b.opts.clock.Now().Sub(start)
+	endSpan(span, err)
+	if b.opts.OnFlush != nil {
+		b.opts.OnFlush(newFlushStats(buff, elapsed, err))
+	}
+	flushDuration.Observe(elapsed.Seconds())
+	flushSize.Observe(float64(len(buff)))
+	if err != nil {
+		flushErrors.Inc()
+		slog.Error("flush error", "batch_size", len(buff), "error", err)
+		for i := range buff {
+			buff[i].result = callback{err: err}
+		}
+		deliverOps(buff)
+		return
+	}
+
+	flushRate.add(len(buff), b.opts.clock.Now())
+	flushedOps.Add(float64(len(buff)))
+
+	deliverOps(buff)
+}
+
+// FlushStats describes a flush for BatcherOptions.OnFlush.
+type FlushStats struct {
+	BatchSize int
+
+	// DirtyUsers is the number of users changed by the flush
+	DirtyUsers int
+
+	// TxCount is the number of ops applied, each logs a point tx
+	TxCount int
+
+	Duration time.Duration
+
+	// Err fails every op of the batch, ops can also fail on their own, e.g. an insufficient balance
+	Err error
+}
+
+func newFlushStats(buff []op, d time.Duration, err error) FlushStats {
+	stats := FlushStats{BatchSize: len(buff), Duration: d, Err: err}
+	if err != nil {
+		return stats
+	}
+
+	users := make(map[string]struct{})
+	for _, p := range buff {
+		if p.result.err != nil {
+			continue
+		}
+		stats.TxCount++
+		users[p.userID] = struct{}{}
+	}
+	stats.DirtyUsers = len(users)
+	return stats
+}
+
+// opLinks links the span of every op to the flush span,
+// a flush serves many callers so none of them can be its parent.
+func opLinks(ops []op) []trace.Link {
+	links := make([]trace.Link, 0, len(ops))
+	for _, p := range ops {
+		if p.ctx == nil {
+			continue
+		}
+		sc := trace.SpanContextFromContext(p.ctx)
+		if sc.IsValid() {
+			links = append(links, trace.Link{SpanContext: sc})
+		}
+	}
+	return links
+}
+
+// deliverOps sends the result of every op not delivered yet,
+// a flush func may call it to deliver before the flush returns.
+func deliverOps(ops []op) {
+	for i := range ops {
+		p := &ops[i]
+		if p.done == nil {
+			continue
+		}
+		p.done <- p.result
+		p.done = nil
+	}
+}
+
+// skipCanceledOps fails the ops whose caller's context is done with the context error
+// and returns the rest, reusing the backing array of buff.
+// Durable ops are never skipped since their pending row would be replayed anyway.
+func skipCanceledOps(buff []op) []op {
+	live := buff[:0]
+	for _, p := range buff {
+		if p.ctx != nil && p.pendingID == 0 && p.ctx.Err() != nil {
+			p.done <- callback{err: p.ctx.Err()}
+			continue
+		}
+		live = append(live, p)
+	}
+	return live
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// recordFlush returns a flush func sending the user ids of every batch to the returned channel.
+func recordFlush() (flushFunc, <-chan []string) {
+	batches := make(chan []string, 16)
+	return func(ctx context.Context, ops []op) error {
+		userIDs := make([]string, 0, len(ops))
+		for i := range ops {
+			userIDs = append(userIDs, ops[i].userID)
+		}
+		batches <- userIDs
+		return nil
+	}, batches
+}
+
+// startBatcher runs b until the test ends.
+func startBatcher(t *testing.T, b *Batcher) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		b.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+}
+
+// submitOp submits an op of the user and returns the channel of its result.
+func submitOp(t *testing.T, b *Batcher, userID string) <-chan callback {
+	t.Helper()
+	done := make(chan callback, 1)
+	err := b.Submit(context.Background(), op{userID: userID, amount: 1, done: done})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return done
+}
+
+// waitQueueEmpty waits for the Run loop to take the queued ops into its buffer.
+func waitQueueEmpty(t *testing.T, b *Batcher) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(b.ops) > 0 || len(b.priorityOps) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("ops still queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func receiveBatch(t *testing.T, batches <-chan []string) []string {
+	t.Helper()
+	select {
+	case batch := <-batches:
+		return batch
+	case <-time.After(5 * time.Second):
+		t.Fatal("no flush")
+		return nil
+	}
+}
+
+func expectNoBatch(t *testing.T, batches <-chan []string) {
+	t.Helper()
+	select {
+	case batch := <-batches:
+		t.Fatalf("unexpected flush of %v", batch)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestBatcherFlushOnInterval(t *testing.T) {
+	clk := newFakeClock()
+	flush, batches := recordFlush()
+	b := NewBatcher(flush, BatcherOptions{
+		FlushInterval: time.Second,
+		FlushSize:     100,
+		QueueSize:     10,
+		clock:         clk,
+	})
+	startBatcher(t, b)
+	<-clk.tickerAdded
+
+	done := []<-chan callback{submitOp(t, b, "a"), submitOp(t, b, "b"), submitOp(t, b, "c")}
+	waitQueueEmpty(t, b)
+	clk.advance(999 * time.Millisecond)
+	expectNoBatch(t, batches)
+
+	clk.advance(time.Millisecond)
+	if batch := receiveBatch(t, batches); len(batch) != 3 {
+		t.Fatalf("flushed %v, want the 3 buffered ops", batch)
+	}
+	for _, d := range done {
+		if cb := <-d; cb.err != nil {
+			t.Fatal(cb.err)
+		}
+	}
+
+	// an empty buffer is not flushed
+	clk.advance(time.Second)
+	expectNoBatch(t, batches)
+}
+
+func TestBatcherFlushOnSize(t *testing.T) {
+	clk := newFakeClock()
+	store := newMemStore(map[string]Points{"a": 5})
+	b := NewBatcher(newPointFlush(store), BatcherOptions{
+		FlushInterval: time.Hour,
+		FlushSize:     3,
+		QueueSize:     10,
+		clock:         clk,
+	})
+	startBatcher(t, b)
+
+	ops := []op{{userID: "a", amount: 10}, {userID: "b", amount: 7}, {userID: "a", amount: -20}}
+	done := make([]chan callback, len(ops))
+	for i, p := range ops[:2] {
+		done[i] = make(chan callback, 1)
+		p.done = done[i]
+		if err := b.Submit(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitQueueEmpty(t, b)
+	if n := store.txCount(); n != 0 {
+		t.Fatalf("flushed %d ops before the buffer is full", n)
+	}
+
+	done[2] = make(chan callback, 1)
+	p := ops[2]
+	p.done = done[2]
+	if err := b.Submit(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []callback{
+		{result: pointResult{balance: 15}},
+		{result: pointResult{created: true, balance: 7}},
+		{err: errInsufficientBalance},
+	}
+	for i := range done {
+		if cb := <-done[i]; cb != want[i] {
+			t.Errorf("op %d: got %+v, want %+v", i, cb, want[i])
+		}
+	}
+	if balance, _ := store.balance("a"); balance != 15 {
+		t.Errorf("balance of a = %v, want 15", balance)
+	}
+	if n := store.txCount(); n != 2 {
+		t.Errorf("got %d tx logs, want 2", n)
+	}
+}
+
+func TestBatcherFlushErrorFailsEveryOp(t *testing.T) {
+	errInsert := errors.New("insert failed")
+	clk := newFakeClock()
+	store := newMemStore(nil)
+	store.insertErr = errInsert
+	b := NewBatcher(newPointFlush(store), BatcherOptions{
+		FlushInterval: time.Second,
+		FlushSize:     100,
+		QueueSize:     10,
+		clock:         clk,
+	})
+	startBatcher(t, b)
+	<-clk.tickerAdded
+
+	var done []<-chan callback
+	for _, userID := range []string{"a", "b", "a", "c"} {
+		done = append(done, submitOp(t, b, userID))
+	}
+	waitQueueEmpty(t, b)
+	clk.advance(time.Second)
+
+	for i, d := range done {
+		if cb := <-d; !errors.Is(cb.err, errInsert) {
+			t.Errorf("op %d: got %+v, want error %v", i, cb, errInsert)
+		}
+	}
+	for _, userID := range []string{"a", "b", "c"} {
+		if _, ok := store.balance(userID); ok {
+			t.Errorf("balance of %s stored by a failed flush", userID)
+		}
+	}
+}
+
+// the ops of a user are checked against the running balance, not netted:
+// -40 overdraws after +100 and -120 even though the batch nets to -10 on top of 50
+func TestBatcherIntermediateBalance(t *testing.T) {
+	store := newMemStore(map[string]Points{"a": 50})
+	b := NewBatcher(newPointFlush(store), BatcherOptions{
+		FlushInterval: time.Hour,
+		FlushSize:     3,
+		QueueSize:     10,
+		clock:         newFakeClock(),
+	})
+	startBatcher(t, b)
+
+	var done []chan callback
+	for _, amount := range []Points{100, -120, -40} {
+		d := make(chan callback, 1)
+		err := b.Submit(context.Background(), op{userID: "a", amount: amount, done: d})
+		if err != nil {
+			t.Fatal(err)
+		}
+		done = append(done, d)
+	}
+
+	want := []callback{
+		{result: pointResult{balance: 150}},
+		{result: pointResult{balance: 30}},
+		{err: errInsufficientBalance},
+	}
+	for i := range done {
+		if cb := <-done[i]; cb != want[i] {
+			t.Errorf("op %d: got %+v, want %+v", i, cb, want[i])
+		}
+	}
+	if balance, _ := store.balance("a"); balance != 30 {
+		t.Errorf("balance = %v, want 30", balance)
+	}
+	if n := store.txCount(); n != 2 {
+		t.Errorf("got %d tx logs, want 2", n)
+	}
+}
+
+// a rejected op between accepted ones of the same flush gets its own error,
+// the ops around it get their own balance and a tx log each
+func TestBatcherMixedResults(t *testing.T) {
+	store := newMemStore(map[string]Points{"a": 10, "b": 5})
+	ops := []op{
+		{userID: "a", amount: -20},
+		{userID: "a", amount: 5},
+		{userID: "b", amount: -5},
+		{userID: "b", amount: -1},
+		{userID: "a", amount: -15},
+		{userID: "c", amount: 7},
+	}
+	b := NewBatcher(newPointFlush(store), BatcherOptions{
+		FlushInterval: time.Hour,
+		FlushSize:     len(ops),
+		QueueSize:     10,
+		clock:         newFakeClock(),
+	})
+	startBatcher(t, b)
+
+	var done []chan callback
+	for _, p := range ops {
+		d := make(chan callback, 1)
+		p.done = d
+		err := b.Submit(context.Background(), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done = append(done, d)
+	}
+
+	want := []callback{
+		{err: errInsufficientBalance},
+		{result: pointResult{balance: 15}},
+		{result: pointResult{balance: 0}},
+		{err: errInsufficientBalance},
+		{result: pointResult{balance: 0}},
+		{result: pointResult{created: true, balance: 7}},
+	}
+	for i := range done {
+		if cb := <-done[i]; cb != want[i] {
+			t.Errorf("op %d: got %+v, want %+v", i, cb, want[i])
+		}
+	}
+
+	var txs []txLog
+	store.do(context.Background(), func(d *memData) { txs = slices.Clone(d.txs) })
+	var got []Points
+	for _, tx := range txs {
+		got = append(got, tx.amount)
+	}
+	if want := []Points{5, -5, -15, 7}; !slices.Equal(got, want) {
+		t.Errorf("tx log amounts = %v, want %v", got, want)
+	}
+}
+
+// with the timer disabled a trickle below FlushSize waits for the fallback tick or the shutdown drain
+func TestBatcherTimerDisabled(t *testing.T) {
+	clk := newFakeClock()
+	flush, batches := recordFlush()
+	b := NewBatcher(flush, BatcherOptions{
+		FlushSize: 100,
+		QueueSize: 10,
+		clock:     clk,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		b.Run(ctx)
+	}()
+	<-clk.tickerAdded
+
+	submitOp(t, b, "a")
+	submitOp(t, b, "b")
+	waitQueueEmpty(t, b)
+	clk.advance(flushFallbackInterval - time.Millisecond)
+	expectNoBatch(t, batches)
+
+	clk.advance(time.Millisecond)
+	if batch := receiveBatch(t, batches); len(batch) != 2 {
+		t.Fatalf("fallback flushed %v, want the 2 buffered ops", batch)
+	}
+
+	submitOp(t, b, "c")
+	waitQueueEmpty(t, b)
+	cancel()
+	<-stopped
+	if batch := receiveBatch(t, batches); len(batch) != 1 || batch[0] != "c" {
+		t.Fatalf("shutdown flushed %v, want [c]", batch)
+	}
+}
+
+// a hung flush fails its ops with the timeout, and the Run loop goes on to the next flush
+func TestBatcherFlushTimeout(t *testing.T) {
+	b := NewBatcher(func(ctx context.Context, ops []op) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, BatcherOptions{
+		FlushInterval: time.Hour,
+		FlushSize:     2,
+		QueueSize:     10,
+		FlushTimeout:  20 * time.Millisecond,
+		clock:         newFakeClock(),
+	})
+	startBatcher(t, b)
+
+	var done []<-chan callback
+	for _, userID := range []string{"a", "b", "c", "d"} {
+		done = append(done, submitOp(t, b, userID))
+	}
+	for i, d := range done {
+		select {
+		case cb := <-d:
+			if !errors.Is(cb.err, context.DeadlineExceeded) {
+				t.Errorf("op %d: got %+v, want error %v", i, cb, context.DeadlineExceeded)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("op %d still blocked on the hung flush", i)
+		}
+	}
+}
+
+// an op canceled while buffered is dropped from the flush and its caller gets the ctx error
+func TestBatcherSkipCanceledOp(t *testing.T) {
+	clk := newFakeClock()
+	store := newMemStore(nil)
+	b := NewBatcher(newPointFlush(store), BatcherOptions{
+		FlushInterval: time.Second,
+		FlushSize:     100,
+		QueueSize:     10,
+		clock:         clk,
+	})
+	startBatcher(t, b)
+	<-clk.tickerAdded
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan callback, 1)
+	err := b.Submit(ctx, op{ctx: ctx, userID: "a", amount: 10, done: canceled})
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := submitOp(t, b, "b")
+	waitQueueEmpty(t, b)
+	cancel()
+	clk.advance(time.Second)
+
+	select {
+	case cb := <-canceled:
+		if !errors.Is(cb.err, context.Canceled) {
+			t.Errorf("canceled op: got %+v, want error %v", cb, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("caller of the canceled op still blocked")
+	}
+	if cb := <-live; cb.err != nil {
+		t.Fatal(cb.err)
+	}
+	if _, ok := store.balance("a"); ok {
+		t.Error("canceled op committed")
+	}
+	if balance, _ := store.balance("b"); balance != 1 {
+		t.Errorf("balance of b = %v, want 1", balance)
+	}
+	if n := store.txCount(); n != 1 {
+		t.Errorf("got %d tx logs, want only the live op", n)
+	}
+}
+
+// the ticker flushes every interval while a steady stream of ops keeps the ops lane ready,
+// so a trickle below FlushSize never waits for more than an interval
+func TestBatcherFlushOnIntervalUnderLoad(t *testing.T) {
+	clk := newFakeClock()
+	flush, batches := recordFlush()
+	b := NewBatcher(flush, BatcherOptions{
+		FlushInterval: time.Second,
+		FlushSize:     1 << 20,
+		QueueSize:     100,
+		clock:         clk,
+	})
+	startBatcher(t, b)
+	<-clk.tickerAdded
+
+	ctx, stop := context.WithCancel(context.Background())
+	fed := make(chan struct{})
+	go func() {
+		defer close(fed)
+		for ctx.Err() == nil {
+			b.Submit(ctx, op{userID: "a", amount: 1, done: make(chan callback, 1)})
+		}
+	}()
+	defer func() {
+		stop()
+		<-fed
+	}()
+
+	for i := 0; i < 5; i++ {
+		// let the queue fill up so the ops lane is always ready
+		for len(b.ops) < cap(b.ops) {
+			time.Sleep(time.Millisecond)
+		}
+		clk.advance(time.Second)
+		if batch := receiveBatch(t, batches); len(batch) == 0 {
+			t.Fatalf("interval %d: empty flush", i)
+		}
+	}
+}
+
+// every op queued before Close gets a result from the drain, every later one ErrBatcherClosed
+func TestBatcherClose(t *testing.T) {
+	b := NewBatcher(func(ctx context.Context, ops []op) error {
+		return nil
+	}, BatcherOptions{
+		FlushInterval: time.Hour,
+		FlushSize:     4,
+		QueueSize:     4,
+		clock:         newFakeClock(),
+	})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		b.Run(context.Background())
+	}()
+
+	const submitters = 8
+	results := make(chan error, submitters)
+	for i := 0; i < submitters; i++ {
+		go func() {
+			for {
+				done := make(chan callback, 1)
+				err := b.Submit(context.Background(), op{userID: "a", done: done})
+				if err != nil {
+					results <- err
+					return
+				}
+				select {
+				case <-done:
+				case <-time.After(5 * time.Second):
+					results <- errors.New("queued op never got a result")
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	b.Close()
+	b.Close()
+	for i := 0; i < submitters; i++ {
+		if err := <-results; !errors.Is(err, ErrBatcherClosed) {
+			t.Errorf("submitter %d: got %v, want %v", i, err, ErrBatcherClosed)
+		}
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Close")
+	}
+
+	err := b.Submit(context.Background(), op{userID: "a", done: make(chan callback, 1)})
+	if !errors.Is(err, ErrBatcherClosed) {
+		t.Errorf("submit after Close: got %v, want %v", err, ErrBatcherClosed)
+	}
+}
+
+// a priority op is flushed with the earlier ops of its user only, the other users wait for the timer
+func TestBatcherFlushPriority(t *testing.T) {
+	clk := newFakeClock()
+	flush, batches := recordFlush()
+	b := NewBatcher(flush, BatcherOptions{
+		FlushInterval: time.Second,
+		FlushSize:     100,
+		QueueSize:     10,
+		clock:         clk,
+	})
+	startBatcher(t, b)
+	<-clk.tickerAdded
+
+	submitOp(t, b, "a")
+	submitOp(t, b, "b")
+	waitQueueEmpty(t, b)
+	submitOp(t, b, "c")
+	submitOp(t, b, "a")
+
+	done := make(chan callback, 1)
+	err := b.Submit(context.Background(), op{userID: "a", amount: 1, priority: true, done: done})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := receiveBatch(t, batches)
+	if !slices.Equal(batch, []string{"a", "a", "a"}) {
+		t.Fatalf("priority flushed %v, want the 2 ops of a then the priority op", batch)
+	}
+	<-done
+
+	expectNoBatch(t, batches)
+	clk.advance(time.Second)
+	if batch := receiveBatch(t, batches); !slices.Equal(batch, []string{"b", "c"}) {
+		t.Fatalf("timer flushed %v, want [b c]", batch)
+	}
+}
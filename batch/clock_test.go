@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// fakeClock is a manual clock, time only moves on advance.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+
+	// tickerAdded receives every ticker created, so a test can wait for the Run loop to start
+	tickerAdded chan *fakeTicker
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:         time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		tickerAdded: make(chan *fakeTicker, 16),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{c: make(chan time.Time, 1), d: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	c.tickerAdded <- t
+	return t
+}
+
+// advance moves the clock by d and fires the tickers that are due,
+// like time.Ticker a ticker drops the ticks its reader is too slow for.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		t.fire(c.now)
+	}
+}
+
+type fakeTicker struct {
+	c chan time.Time
+	d time.Duration
+
+	mu      sync.Mutex
+	next    time.Time
+	stopped bool
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.mu.Lock()
+	t.stopped = true
+	t.mu.Unlock()
+}
+
+func (t *fakeTicker) fire(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for !t.stopped && !t.next.After(now) {
+		select {
+		case t.c <- now:
+		default:
+		}
+		t.next = t.next.Add(t.d)
+	}
+}
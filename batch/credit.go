@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/acoshift/pgsql"
+	"github.com/acoshift/pgsql/pgctx"
+	"github.com/acoshift/pgsql/pgstmt"
+)
+
+var (
+	creditAllAmount = flag.String("credit-all", "", "credit every user of every db this amount of points, e.g. 10 or 10.50, then exit without running the benchmark")
+	creditAllReason = flag.String("credit-reason", "promotion", "reason logged on the point txs of -credit-all")
+)
+
+// creditAll adds amount to the balance of every user and logs a point tx with reason for each of them,
+// in a single transaction. A debit that overdraws any user fails with errInsufficientBalance.
+func creditAll(ctx context.Context, amount Points, reason string) error {
+	return pgctx.RunInTx(ctx, func(ctx context.Context) error {
+		var userIDs []string
+		err := pgctx.Iter(ctx, func(scan pgsql.Scanner) error {
+			var userID string
+			err := scan(&userID)
+			if err != nil {
+				return err
+			}
+			userIDs = append(userIDs, userID)
+			return nil
+		}, tableSQL(`
+			update {user_points}
+			set balance = balance + $1
+			returning user_id
+		`), amount)
+		if isBalanceCheckViolation(err) {
+			return errInsufficientBalance
+		}
+		if err != nil {
+			return err
+		}
+
+		// stay under the bind parameter limit, at most 4 parameters per row
+		ids := getTxIDStrategy()
+		for _, chunk := range chunkSlice(userIDs, maxQueryParams/4) {
+			_, err = creditTxsStmt(ids, chunk, amount, reason).ExecWith(ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+		pgctx.Committed(ctx, func(context.Context) {
+			resetBalanceCache()
+		})
+		return nil
+	})
+}
+
+// creditTxsStmt builds the statement that logs a credit of amount with reason for every user.
+func creditTxsStmt(ids txIDStrategy, userIDs []string, amount Points, reason string) *pgstmt.Result {
+	return pgstmt.Insert(func(b pgstmt.InsertStatement) {
+		b.Into(tableName("point_txs"))
+		if ids == txIDSerial {
+			b.Columns("user_id", "amount", "reason")
+			for _, userID := range userIDs {
+				b.Value(userID, amount, reason)
+			}
+			return
+		}
+
+		b.Columns("id", "user_id", "amount", "reason")
+		for _, userID := range userIDs {
+			b.Value(ids.newID(), userID, amount, reason)
+		}
+	})
+}
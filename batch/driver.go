@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/acoshift/pgsql/pgctx"
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/lib/pq"
+)
+
+var driverName = flag.String("driver", "postgres", "database/sql driver, postgres (lib/pq) or pgx (pgx/stdlib); "+
+	"pgsql only retries lib/pq serialization failures inside a tx, use -retry-attempts with pgx")
+
+// sqlDriver is the driver specific part of the queries.
+type sqlDriver interface {
+	// array wraps a slice bound as a single array parameter
+	array(v any) any
+
+	// copyIn inserts rows into table using COPY FROM STDIN, it must be called inside a tx
+	copyIn(ctx context.Context, table string, columns []string, rows [][]any) error
+
+	// errorCode returns the SQLSTATE and constraint name of a postgres error,
+	// ok is false when err is not a postgres error
+	errorCode(err error) (code, constraint string, ok bool)
+}
+
+// dbDriver is set from -driver by setupDriver
+var dbDriver sqlDriver = pqDriver{}
+
+// setupDriver selects the driver, it must be called after flag.Parse.
+func setupDriver() error {
+	switch *driverName {
+	case "postgres":
+		dbDriver = pqDriver{}
+	case "pgx":
+		dbDriver = pgxDriver{}
+	default:
+		return fmt.Errorf("unknown driver %q", *driverName)
+	}
+	return nil
+}
+
+type pqDriver struct{}
+
+func (pqDriver) array(v any) any {
+	return pq.Array(v)
+}
+
+func (pqDriver) copyIn(ctx context.Context, table string, columns []string, rows [][]any) error {
+	stmt, err := pgctx.GetTx(ctx).PrepareContext(ctx, pq.CopyIn(table, columns...))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, row := range rows {
+		_, err = stmt.ExecContext(ctx, row...)
+		if err != nil {
+			return err
+		}
+	}
+
+	// flush buffered rows
+	_, err = stmt.ExecContext(ctx)
+	return err
+}
+
+func (pqDriver) errorCode(err error) (code, constraint string, ok bool) {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return "", "", false
+	}
+	return string(pqErr.Code), pqErr.Constraint, true
+}
+
+type pgxDriver struct{}
+
+// array returns v as is, pgx encodes slices as arrays.
+func (pgxDriver) array(v any) any {
+	return v
+}
+
+// copyIn is not supported, pgx copies on its own connection which database/sql does not expose inside a tx.
+func (pgxDriver) copyIn(ctx context.Context, table string, columns []string, rows [][]any) error {
+	return errors.New("pgx: copy is not supported through database/sql")
+}
+
+func (pgxDriver) errorCode(err error) (code, constraint string, ok bool) {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return "", "", false
+	}
+	return pgErr.Code, pgErr.ConstraintName, true
+}
+
+// isErrorCode reports whether err is a postgres error with SQLSTATE code.
+func isErrorCode(err error, code string) bool {
+	c, _, ok := dbDriver.errorCode(err)
+	return ok && c == code
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/acoshift/pgsql"
+	"github.com/acoshift/pgsql/pgctx"
+)
+
+// appendPendingOp persists an op before it is queued, so it survives a crash before flush.
+func appendPendingOp(ctx context.Context, userID string, amount Points) (int64, error) {
+	var id int64
+	err := pgctx.QueryRow(ctx, tableSQL(`
+		insert into {pending_ops} (user_id, amount)
+		values ($1, $2)
+		returning id
+	`), userID, amount).Scan(&id)
+	return id, err
+}
+
+// deletePendingOps removes the pending rows of flushed ops, it must run in the flush tx,
+// or of ops that were never queued.
+func deletePendingOps(ctx context.Context, ops []op) error {
+	ids := make([]int64, 0, len(ops))
+	for _, p := range ops {
+		if p.pendingID > 0 {
+			ids = append(ids, p.pendingID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	_, err := pgctx.Exec(ctx, tableSQL(`
+		delete from {pending_ops}
+		where id = any($1)
+	`), dbDriver.array(ids))
+	return err
+}
+
+// dropFailedPendingOps deletes the pending rows of ops whose flush failed, before their error is delivered.
+// The caller gets the error and may submit the op again, so a later replay must not apply it a second time.
+// A replayed op has no caller to retry it, its row stays for the next replay.
+func dropFailedPendingOps(ctx context.Context, ops []op) {
+	var failed []op
+	for _, p := range ops {
+		if p.pendingID > 0 && p.ctx != nil {
+			failed = append(failed, p)
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+
+	// the flush ctx may be what failed it
+	err := deletePendingOps(context.WithoutCancel(ctx), failed)
+	if err != nil {
+		slog.Error("can not delete the pending ops of a failed flush, a replay applies them", "ops", len(failed), "error", err)
+	}
+}
+
+// replayPendingOps applies ops left in pending_ops by a previous run through the shard worker,
+// in the order they were appended.
+func replayPendingOps(ctx context.Context, s shard) error {
+	var ops []op
+	err := pgctx.Iter(pgctx.NewContext(ctx, s.db), func(scan pgsql.Scanner) error {
+		p := op{weight: 1}
+		err := scan(&p.pendingID, &p.userID, &p.amount)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, p)
+		return nil
+	}, tableSQL(`
+		select id, user_id, amount
+		from {pending_ops}
+		order by id
+	`))
+	if err != nil {
+		return err
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+
+	done := make(chan callback, len(ops))
+	for _, p := range ops {
+		p.done = done
+		err := s.batcher.Submit(ctx, p)
+		if err != nil {
+			return err
+		}
+	}
+
+	var failed int
+	for range ops {
+		cb := <-done
+		if cb.err != nil {
+			failed++
+		}
+	}
+	slog.Info("replayed pending ops", "ops", len(ops), "failed", failed)
+	return nil
+}
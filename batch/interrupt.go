@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// interrupted is done once SIGINT or SIGTERM is received, set by notifyInterrupt.
+// It ends the running load test early and skips the rest, the batchers still drain.
+var interrupted = context.Background()
+
+// notifyInterrupt sets interrupted, stop restores the default signal handling.
+func notifyInterrupt() (stop func()) {
+	var cancel context.CancelFunc
+	interrupted, cancel = signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	return cancel
+}
+
+// stopIfInterrupted prints the summary of the load tests run so far and returns true when interrupted,
+// the caller then returns so the deferred cleanup runs.
+func stopIfInterrupted() bool {
+	if interrupted.Err() == nil {
+		return false
+	}
+	fmt.Println("interrupted, skipping the remaining load tests")
+	printLoadTestSummary()
+	return true
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// latencyHistogram counts durations into power of two microsecond buckets,
+// cheap enough to observe every op without a lock.
+type latencyHistogram struct {
+	// buckets[i] counts durations below 2^i microseconds,
+	// the last bucket also counts everything above
+	buckets [32]atomic.Uint64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	us := uint64(d / time.Microsecond)
+	i := 0
+	for i < len(h.buckets)-1 && us >= 1<<i {
+		i++
+	}
+	h.buckets[i].Add(1)
+}
+
+func (h *latencyHistogram) reset() {
+	for i := range h.buckets {
+		h.buckets[i].Store(0)
+	}
+}
+
+// percentile returns the upper bound of the bucket holding the p-th percentile.
+func (h *latencyHistogram) percentile(p int) time.Duration {
+	var counts [len(h.buckets)]uint64
+	var total uint64
+	for i := range h.buckets {
+		counts[i] = h.buckets[i].Load()
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := (total*uint64(p) + 99) / 100
+	var sum uint64
+	for i, c := range counts {
+		sum += c
+		if sum >= rank {
+			return time.Duration(1<<i) * time.Microsecond
+		}
+	}
+	return time.Duration(1<<(len(counts)-1)) * time.Microsecond
+}
+
+func (h *latencyHistogram) count() uint64 {
+	var total uint64
+	for i := range h.buckets {
+		total += h.buckets[i].Load()
+	}
+	return total
+}
+
+// String formats the p50, p90 and p99 upper bounds.
+func (h *latencyHistogram) String() string {
+	return fmt.Sprintf("p50 < %s, p90 < %s, p99 < %s", h.percentile(50), h.percentile(90), h.percentile(99))
+}
+
+// batch op latency, split into waiting to be accepted by a batcher and waiting for its flush
+var (
+	enqueueLatency latencyHistogram
+	flushLatency   latencyHistogram
+)
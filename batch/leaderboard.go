@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// serveLeaderboard serves GET /leaderboard?limit= as a json array of the top users.
+func serveLeaderboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, ok := queryLimit(r)
+	if !ok {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	users, err := topUsers(readCtx(r.Context()), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if users == nil {
+		users = []UserBalance{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// serveBalances serves GET /balances?user_id=&user_id= as a json object of user id to balance.
+func serveBalances(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userIDs := r.URL.Query()["user_id"]
+	if len(userIDs) == 0 || len(userIDs) > 1000 {
+		http.Error(w, "invalid user_id", http.StatusBadRequest)
+		return
+	}
+
+	balances, err := getBalances(readCtx(r.Context()), userIDs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(balances)
+}
+
+// serveBalance serves GET /balance?user_id= as the json balance of the user,
+// read through the balance cache when -balance-cache is set.
+func serveBalance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		http.Error(w, "invalid user_id", http.StatusBadRequest)
+		return
+	}
+
+	// the cache is kept fresh by the writes to the main db, a replica would fill it with stale balances
+	balance, err := getBalanceCached(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UserBalance{UserID: userID, Balance: balance})
+}
+
+// serveTxs serves GET /txs?user_id=&limit= as a json array of the latest transactions of the user, newest first.
+func serveTxs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		http.Error(w, "invalid user_id", http.StatusBadRequest)
+		return
+	}
+	limit, ok := queryLimit(r)
+	if !ok {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	txs, err := recentTxs(readCtx(r.Context()), userID, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if txs == nil {
+		txs = []Tx{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(txs)
+}
+
+// queryLimit parses the limit query parameter of r, 10 when unset, false when it is not in 1 to 1000.
+func queryLimit(r *http.Request) (int, bool) {
+	s := r.URL.Query().Get("limit")
+	if s == "" {
+		return 10, true
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit <= 0 || limit > 1000 {
+		return 0, false
+	}
+	return limit, true
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// invalid parameters are rejected before any query
+func TestServeTxsInvalid(t *testing.T) {
+	for _, target := range []string{
+		"/txs",
+		"/txs?limit=5",
+		"/txs?user_id=a&limit=0",
+		"/txs?user_id=a&limit=1001",
+		"/txs?user_id=a&limit=x",
+	} {
+		w := httptest.NewRecorder()
+		serveTxs(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", target, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	serveTxs(w, httptest.NewRequest(http.MethodPost, "/txs?user_id=a", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("post: got %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"github.com/acoshift/pgsql"
+	"github.com/acoshift/pgsql/pgctx"
+)
+
+var trackLostUpdates = flag.Bool("track-lost-updates", false, "track the expected balance of every user in memory and report the drift from user_points after each load test")
+
+// expectedTotals is the sum of the amounts of successful ops per user in Points,
+// the balance a user must have when no update was lost.
+var expectedTotals sync.Map // map[string]*atomic.Int64
+
+func addExpectedTotal(userID string, amount Points) {
+	v, ok := expectedTotals.Load(userID)
+	if !ok {
+		v, _ = expectedTotals.LoadOrStore(userID, new(atomic.Int64))
+	}
+	v.(*atomic.Int64).Add(int64(amount))
+}
+
+func resetExpectedTotals() {
+	expectedTotals.Range(func(key, _ any) bool {
+		expectedTotals.Delete(key)
+		return true
+	})
+}
+
+// printLostUpdates compares the expected totals against the balances in dbs
+// and prints the number of drifted users and the total drift.
+func printLostUpdates(ctx context.Context, dbs []*sql.DB) {
+	balances := make(map[string]Points)
+	for _, db := range dbs {
+		var (
+			userID  string
+			balance Points
+		)
+		err := pgctx.Iter(pgctx.NewContext(ctx, db), func(scan pgsql.Scanner) error {
+			err := scan(&userID, &balance)
+			if err != nil {
+				return err
+			}
+			balances[userID] = balance
+			return nil
+		}, tableSQL(`select user_id, balance from {user_points}`))
+		if err != nil {
+			slog.Error("can not load balances", "error", err)
+			return
+		}
+	}
+
+	var (
+		users int64
+		drift Points
+	)
+	expectedTotals.Range(func(key, value any) bool {
+		d := Points(value.(*atomic.Int64).Load()) - balances[key.(string)]
+		if d != 0 {
+			users++
+			if d < 0 {
+				d = -d
+			}
+			drift += d
+		}
+		return true
+	})
+	fmt.Printf("lost update users: %d\n", users)
+	fmt.Printf("lost update drift: %s\n", drift)
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	setupTables()
+	os.Exit(m.Run())
+}
+
+// setFlag sets the flag for the test and restores it on cleanup.
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	f := flag.Lookup(name)
+	if f == nil {
+		t.Fatalf("unknown flag %q", name)
+	}
+	prev := f.Value.String()
+	if err := f.Value.Set(value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Value.Set(prev) })
+}
+
+func TestApplyPointOps(t *testing.T) {
+	state := map[string]Points{"a": 50}
+	ops := []op{
+		{userID: "a", amount: 20},
+		{userID: "b", amount: 30},
+		{userID: "a", amount: -100},
+		{userID: "b", amount: -10},
+		{userID: "c", amount: -1},
+	}
+
+	dirty, txLogs := applyPointOps(ops, state, txIDUUID, nil)
+
+	want := []callback{
+		{result: pointResult{created: false, balance: 70}},
+		{result: pointResult{created: true, balance: 30}},
+		{err: errInsufficientBalance},
+		{result: pointResult{created: false, balance: 20}},
+		{err: errInsufficientBalance},
+	}
+	for i, p := range ops {
+		if p.result != want[i] {
+			t.Errorf("op %d: got %+v, want %+v", i, p.result, want[i])
+		}
+	}
+
+	if len(dirty) != 2 || dirty["a"] != 70 || dirty["b"] != 20 {
+		t.Errorf("dirty = %v, want map[a:70 b:20]", dirty)
+	}
+	if state["a"] != 50 || len(state) != 1 {
+		t.Errorf("state modified: %v", state)
+	}
+
+	if len(txLogs) != 3 {
+		t.Fatalf("got %d tx logs, want 3", len(txLogs))
+	}
+	for i, w := range []txLog{{userID: "a", amount: 20}, {userID: "b", amount: 30}, {userID: "b", amount: -10}} {
+		if txLogs[i].userID != w.userID || txLogs[i].amount != w.amount || txLogs[i].txID == "" {
+			t.Errorf("tx log %d = %+v, want %+v with an id", i, txLogs[i], w)
+		}
+	}
+}
+
+// netting the batch to +10 would accept the debit, the running balance rejects it
+func TestApplyPointOpsIntermediateBalance(t *testing.T) {
+	ops := []op{
+		{userID: "a", amount: -10},
+		{userID: "a", amount: 20},
+	}
+
+	dirty, txLogs := applyPointOps(ops, map[string]Points{}, txIDUUID, nil)
+
+	want := []callback{
+		{err: errInsufficientBalance},
+		{result: pointResult{created: true, balance: 20}},
+	}
+	for i, p := range ops {
+		if p.result != want[i] {
+			t.Errorf("op %d: got %+v, want %+v", i, p.result, want[i])
+		}
+	}
+	if dirty["a"] != 20 {
+		t.Errorf("balance of a = %v, want 20", dirty["a"])
+	}
+	if len(txLogs) != 1 || txLogs[0].amount != 20 {
+		t.Errorf("tx logs = %+v, want only the credit", txLogs)
+	}
+}
+
+func TestWritePointOps(t *testing.T) {
+	store := newMemStore(map[string]Points{"a": 50})
+	ops := []op{
+		{userID: "a", amount: -20},
+		{userID: "b", amount: 10},
+	}
+
+	err := store.RunInTx(context.Background(), func(ctx context.Context) error {
+		state, err := store.Balances(ctx, []string{"a", "b"})
+		if err != nil {
+			return err
+		}
+		dirty, txLogs := applyPointOps(ops, state, txIDUUID, nil)
+		return writePointOps(ctx, store, ops, txIDUUID, txLogs, dirty)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b, _ := store.balance("a"); b != 30 {
+		t.Errorf("balance of a = %v, want 30", b)
+	}
+	if b, _ := store.balance("b"); b != 10 {
+		t.Errorf("balance of b = %v, want 10", b)
+	}
+	if n := store.txCount(); n != 2 {
+		t.Errorf("got %d tx logs, want 2", n)
+	}
+}
+
+func TestWritePointOpsErrorDiscardsTx(t *testing.T) {
+	errInsert := errors.New("insert failed")
+	store := newMemStore(map[string]Points{"a": 50})
+	store.insertErr = errInsert
+	ops := []op{{userID: "a", amount: -20}}
+
+	err := store.RunInTx(context.Background(), func(ctx context.Context) error {
+		dirty, txLogs := applyPointOps(ops, map[string]Points{"a": 50}, txIDUUID, nil)
+		return writePointOps(ctx, store, ops, txIDUUID, txLogs, dirty)
+	})
+	if !errors.Is(err, errInsert) {
+		t.Fatalf("got error %v, want %v", err, errInsert)
+	}
+	if b, _ := store.balance("a"); b != 50 {
+		t.Errorf("balance of a = %v, want 50", b)
+	}
+}
+
+func TestWritePointOpsDryRun(t *testing.T) {
+	setFlag(t, "dry-run", "true")
+
+	store := newMemStore(map[string]Points{"a": 50})
+	ops := []op{{userID: "a", amount: -20}}
+
+	err := store.RunInTx(context.Background(), func(ctx context.Context) error {
+		dirty, txLogs := applyPointOps(ops, map[string]Points{"a": 50}, txIDUUID, nil)
+		return writePointOps(ctx, store, ops, txIDUUID, txLogs, dirty)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := store.balance("a"); b != 50 {
+		t.Errorf("balance of a = %v, want 50", b)
+	}
+	if n := store.txCount(); n != 0 {
+		t.Errorf("got %d tx logs, want 0", n)
+	}
+	if ops[0].result.result.balance != 30 {
+		t.Errorf("dry run result = %+v, want balance 30", ops[0].result)
+	}
+}
+
+func TestPointFlushCommitBatchSize(t *testing.T) {
+	setFlag(t, "commit-batch-size", "2")
+
+	errInsert := errors.New("insert failed")
+	store := newMemStore(map[string]Points{"a": 10})
+	flush := newPointFlush(store)
+
+	ops := make([]op, 5)
+	for i := range ops {
+		ops[i] = op{userID: "a", amount: 10, done: make(chan callback, 1)}
+	}
+	err := flush(context.Background(), ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := store.balance("a"); b != 60 {
+		t.Errorf("balance of a = %v, want 60", b)
+	}
+	if n := store.txCount(); n != 5 {
+		t.Errorf("got %d tx logs, want 5", n)
+	}
+
+	// a failed chunk sets its error on its ops, the batcher delivers them after the flush
+	store.insertErr = errInsert
+	ops = ops[:3]
+	for i := range ops {
+		ops[i] = op{userID: "a", amount: -10, done: make(chan callback, 1)}
+	}
+	err = flush(context.Background(), ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range ops {
+		if !errors.Is(p.result.err, errInsert) {
+			t.Errorf("op %d: got %+v, want error %v", i, p.result, errInsert)
+		}
+	}
+	if b, _ := store.balance("a"); b != 60 {
+		t.Errorf("balance of a = %v, want 60", b)
+	}
+}
+
+func TestPointFlushCreated(t *testing.T) {
+	store := newMemStore(nil)
+	flush := newPointFlush(store)
+
+	run := func(amounts ...Points) []callback {
+		ops := make([]op, len(amounts))
+		for i, amount := range amounts {
+			ops[i] = op{userID: "new", amount: amount}
+		}
+		err := flush(context.Background(), ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results := make([]callback, len(ops))
+		for i := range ops {
+			results[i] = ops[i].result
+		}
+		return results
+	}
+
+	// the first op of a user creates its balance, the next ops in and after the batch do not
+	got := run(10, 5)
+	want := []callback{
+		{result: pointResult{created: true, balance: 10}},
+		{result: pointResult{created: false, balance: 15}},
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("first flush op %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	if got := run(1); got[0] != (callback{result: pointResult{created: false, balance: 16}}) {
+		t.Errorf("second flush: got %+v, want created false", got[0])
+	}
+}
+
+func TestChunkSlice(t *testing.T) {
+	xs := make([]int, 7)
+	for i := range xs {
+		xs[i] = i
+	}
+	tests := []struct {
+		size int
+		want []int
+	}{
+		{3, []int{3, 3, 1}},
+		{7, []int{7}},
+		{10, []int{7}},
+		{1, []int{1, 1, 1, 1, 1, 1, 1}},
+	}
+	for _, tt := range tests {
+		chunks := chunkSlice(xs, tt.size)
+		var sizes, all []int
+		for _, chunk := range chunks {
+			sizes = append(sizes, len(chunk))
+			all = append(all, chunk...)
+		}
+		if !slices.Equal(sizes, tt.want) {
+			t.Errorf("chunkSlice(7 elements, %d) sizes = %v, want %v", tt.size, sizes, tt.want)
+		}
+		if !slices.Equal(all, xs) {
+			t.Errorf("chunkSlice(7 elements, %d) = %v, want every element in order", tt.size, chunks)
+		}
+	}
+	if chunks := chunkSlice([]int(nil), 3); len(chunks) != 0 {
+		t.Errorf("chunkSlice(nil) = %v, want no chunk", chunks)
+	}
+}
+
+func TestWaitLoadWorkers(t *testing.T) {
+	var workers sync.WaitGroup
+	release := make(chan struct{})
+	workers.Add(2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			defer workers.Done()
+			<-release
+		}()
+	}
+
+	if waitLoadWorkers(&workers, 10*time.Millisecond) {
+		t.Fatal("wait returned with workers still running")
+	}
+	close(release)
+	if !waitLoadWorkers(&workers, 5*time.Second) {
+		t.Fatal("wait timed out after the workers returned")
+	}
+
+	// the next load test gets its own wait group, the timed out wait above never blocks it
+	var next sync.WaitGroup
+	if !waitLoadWorkers(&next, 10*time.Millisecond) {
+		t.Fatal("wait on an empty wait group timed out")
+	}
+}
+
+func TestLoadStopTimeout(t *testing.T) {
+	setFlag(t, "flush-timeout", "3s")
+	prevCfg := cfg
+	t.Cleanup(func() { cfg = prevCfg })
+
+	for _, tt := range []struct {
+		interval time.Duration
+		want     time.Duration
+	}{
+		{0, flushFallbackInterval + 3*time.Second},
+		{10 * time.Millisecond, flushFallbackInterval + 3*time.Second},
+		{time.Minute, time.Minute + 3*time.Second},
+	} {
+		cfg.FlushInterval = tt.interval
+		if got := loadStopTimeout(); got != tt.want {
+			t.Errorf("flush interval %s: stop timeout = %s, want %s", tt.interval, got, tt.want)
+		}
+	}
+}
+
+// startMemShards runs a batcher per store as the shards until the test ends.
+func startMemShards(t *testing.T, stores ...*memStore) {
+	t.Helper()
+	prev := getShards()
+	started := make([]shard, len(stores))
+	for i, store := range stores {
+		started[i] = shard{batcher: NewBatcher(newPointFlush(store), BatcherOptions{
+			FlushInterval: time.Millisecond,
+			FlushSize:     10,
+			QueueSize:     10,
+		})}
+		startBatcher(t, started[i].batcher)
+	}
+	shards.Store(&started)
+	t.Cleanup(func() { shards.Store(&prev) })
+}
+
+func TestShardRouting(t *testing.T) {
+	stores := []*memStore{newMemStore(nil), newMemStore(nil)}
+	startMemShards(t, stores...)
+
+	shardIndex := func(userID string) int {
+		return slices.IndexFunc(getShards(), func(s shard) bool { return s.batcher == shardOf(userID).batcher })
+	}
+
+	owner := make(map[string]int)
+	for i := 0; i < 20; i++ {
+		userID := fmt.Sprintf("user-%d", i)
+		owner[userID] = shardIndex(userID)
+		for k := 0; k < 3; k++ {
+			_, err := addPointBatch(context.Background(), userID, Points(i+1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if shardIndex(userID) != owner[userID] {
+				t.Fatalf("%s moved to another shard", userID)
+			}
+		}
+	}
+
+	used := make(map[int]bool)
+	for userID, owned := range owner {
+		used[owned] = true
+		i, _ := strconv.Atoi(strings.TrimPrefix(userID, "user-"))
+		if balance, _ := stores[owned].balance(userID); balance != Points(3*(i+1)) {
+			t.Errorf("balance of %s = %v on its shard, want %v", userID, balance, 3*(i+1))
+		}
+		for j, other := range stores {
+			if _, ok := other.balance(userID); j != owned && ok {
+				t.Errorf("%s has a balance on shard %d, owned by shard %d", userID, j, owned)
+			}
+		}
+	}
+	if len(used) != len(stores) {
+		t.Errorf("users routed to %d of %d shards", len(used), len(stores))
+	}
+}
+
+// a priority op is flushed right away, the interval and the buffer size are never reached
+func TestAddPointBatchPriority(t *testing.T) {
+	store := newMemStore(nil)
+	prev := getShards()
+	started := []shard{{batcher: NewBatcher(newPointFlush(store), BatcherOptions{
+		FlushInterval: time.Hour,
+		FlushSize:     10,
+		QueueSize:     10,
+		clock:         newFakeClock(),
+	})}}
+	startBatcher(t, started[0].batcher)
+	shards.Store(&started)
+	t.Cleanup(func() { shards.Store(&prev) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := addPointBatchPriority(ctx, "user", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the load workers pick priority ops on the ctx of addPointBatch
+	res, err := addPointBatch(withPriority(ctx), "user", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.balance != 3 {
+		t.Errorf("balance = %v, want 3", res.balance)
+	}
+}
+
+// the queued ops gauge reads the shards while they are restarted, the race detector catches an unsynchronized swap
+func TestQueuedOpsShardRestart(t *testing.T) {
+	prev := getShards()
+	t.Cleanup(func() { shards.Store(&prev) })
+
+	noFlush := func() flushFunc {
+		return func(context.Context, []op) error { return nil }
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			queuedOpCount()
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		stop := startShards(context.Background(), make([]*sql.DB, 2), noFlush)
+		if n := len(getShards()); n != 2 {
+			t.Errorf("%d shards running, want 2", n)
+		}
+		stop()
+	}
+	<-done
+}
+
+func TestBalanceCheckCost(t *testing.T) {
+	if cost, ok := balanceCheckCost(900, 1000); !ok || cost != 100 {
+		t.Errorf("balanceCheckCost(900, 1000) = %d, %v, want 100, true", cost, ok)
+	}
+
+	setFlag(t, "upsert", "increment")
+	if cost, ok := balanceCheckCost(900, 1000); ok {
+		t.Errorf("balanceCheckCost under the increment upsert = %d, want none", cost)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/acoshift/pgsql"
+)
+
+// memStore is an in-memory pointsStore, a transaction works on a copy of the store
+// that replaces it on commit, and transactions run one at a time.
+type memStore struct {
+	mu   sync.Mutex
+	data memData
+
+	// insertErr fails InsertTxs when set
+	insertErr error
+}
+
+type memData struct {
+	balances map[string]Points
+	txs      []txLog
+}
+
+type memTxKey struct{}
+
+func newMemStore(balances map[string]Points) *memStore {
+	if balances == nil {
+		balances = map[string]Points{}
+	}
+	return &memStore{data: memData{balances: balances}}
+}
+
+func (s *memStore) RunInTx(ctx context.Context, f func(ctx context.Context) error) error {
+	if ctx.Value(memTxKey{}) != nil {
+		return f(ctx)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &memData{
+		balances: maps.Clone(s.data.balances),
+		txs:      slices.Clone(s.data.txs),
+	}
+	err := f(context.WithValue(ctx, memTxKey{}, tx))
+	if errors.Is(err, pgsql.ErrAbortTx) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.data = *tx
+	return nil
+}
+
+// do runs f on the data of the tx in ctx, or on the store outside a tx.
+func (s *memStore) do(ctx context.Context, f func(d *memData)) {
+	if tx, ok := ctx.Value(memTxKey{}).(*memData); ok {
+		f(tx)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(&s.data)
+}
+
+func (s *memStore) Balances(ctx context.Context, userIDs []string) (map[string]Points, error) {
+	balances := make(map[string]Points, len(userIDs))
+	s.do(ctx, func(d *memData) {
+		for _, userID := range userIDs {
+			if balance, ok := d.balances[userID]; ok {
+				balances[userID] = balance
+			}
+		}
+	})
+	return balances, nil
+}
+
+func (s *memStore) UpsertBalances(ctx context.Context, balances map[string]Points) error {
+	s.do(ctx, func(d *memData) {
+		maps.Copy(d.balances, balances)
+	})
+	return nil
+}
+
+func (s *memStore) InsertTxs(ctx context.Context, ids txIDStrategy, txLogs []txLog) error {
+	if s.insertErr != nil {
+		return s.insertErr
+	}
+	s.do(ctx, func(d *memData) {
+		d.txs = append(d.txs, txLogs...)
+	})
+	return nil
+}
+
+// balance returns the committed balance of the user.
+func (s *memStore) balance(userID string) (Points, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	balance, ok := s.data.balances[userID]
+	return balance, ok
+}
+
+// txCount returns the number of committed tx logs.
+func (s *memStore) txCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.data.txs)
+}
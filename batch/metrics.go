@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// batcher metrics, served at /metrics on the debug server
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	flushDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "batch_flush_duration_seconds",
+		Help:    "Duration of batch flushes.",
+		Buckets: prometheus.DefBuckets,
+	})
+	flushSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "batch_flush_size",
+		Help:    "Number of ops in a batch flush.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+	})
+	bufferedOps = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "batch_buffered_ops",
+		Help: "Number of ops buffered for the next flush across batchers.",
+	})
+	queuedOps = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "batch_queued_ops",
+		Help: "Number of submitted ops waiting for a batcher run loop.",
+	}, queuedOpCount)
+	flushedOps = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "batch_flushed_ops_total",
+		Help: "Number of ops in successful flushes.",
+	})
+	flushErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "batch_flush_errors_total",
+		Help: "Number of failed flushes.",
+	})
+	shedOps = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "batch_shed_ops_total",
+		Help: "Number of ops failed with system busy because their batcher queue was full.",
+	})
+	flushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "batch_flushes_total",
+		Help: "Number of flushes by trigger, full, adaptive, timer, priority or drain.",
+	}, []string{"reason"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(flushDuration, flushSize, bufferedOps, queuedOps, flushedOps, flushErrors, shedOps, flushes)
+	http.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+}
+
+// queuedOpCount returns the number of ops queued on every lane of the running shards.
+func queuedOpCount() float64 {
+	var cnt int
+	for _, s := range getShards() {
+		cnt += len(s.batcher.ops) + len(s.batcher.priorityOps)
+	}
+	return float64(cnt)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/acoshift/pgsql/pgctx"
+)
+
+var (
+	reset         = flag.Bool("reset", false, "truncate user_points, point_txs and pending_ops before migrating")
+	allowTruncate = flag.Bool("truncate", false, "truncate user_points and point_txs between load tests, "+
+		"allowed without the flag only when every db is named like a test db, e.g. points_test or bench")
+)
+
+// truncateEnabled is set by main when every db may be truncated between load tests.
+var truncateEnabled bool
+
+// migration is a versioned schema change, applied once and recorded in schema_migrations.
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// migrations are applied in order, append new ones and never edit an applied one.
+// The first migrations use if not exists since they predate schema_migrations.
+// Every migration must stay idempotent, recreatePointTxs replays them all on the existing tables.
+var migrations = []migration{
+	{1, "create tables", `
+		create table if not exists {user_points} (
+		    user_id varchar,
+		    balance bigint not null,
+		    primary key (user_id)
+		);
+		create table if not exists {pending_ops} (
+		    id bigserial,
+		    user_id varchar not null,
+		    amount bigint not null,
+		    created_at timestamptz not null default now(),
+		    primary key (id)
+		);
+		create table if not exists {point_txs} (
+		    id uuid,
+		    user_id varchar not null,
+		    amount bigint not null,
+		    created_at timestamptz not null default now(),
+		    primary key (id)
+		);
+	`},
+	// fails when a run without balance checks left negative balances, run with -reset
+	{2, "add balance check", `
+		do $$
+		begin
+		    alter table {user_points} add constraint {user_points_balance_check} check (balance >= 0);
+		exception when duplicate_object then
+		end $$;
+	`},
+	{3, "index point txs by user", `
+		create index if not exists {point_txs_user_id_created_at_idx} on {point_txs} (user_id, created_at desc);
+	`},
+	{4, "index balances", `
+		create index if not exists {user_points_balance_idx} on {user_points} (balance desc);
+	`},
+	{5, "add tx reason", `
+		alter table {point_txs} add column if not exists reason varchar;
+	`},
+}
+
+// migrate applies the migrations missing from schema_migrations of the db in ctx,
+// then sets the amount columns to -amount-type.
+func migrate(ctx context.Context) error {
+	_, err := pgctx.Exec(ctx, tableSQL(`
+		create table if not exists {schema_migrations} (
+		    version int,
+		    name varchar not null,
+		    applied_at timestamptz not null default now(),
+		    primary key (version)
+		)
+	`))
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		err = applyMigration(ctx, m)
+		if err != nil {
+			return fmt.Errorf("migration %d %s: %w", m.version, m.name, err)
+		}
+	}
+
+	return setAmountColumnTypes(ctx)
+}
+
+// amountColumns are the columns typed by -amount-type.
+var amountColumns = []struct{ table, column string }{
+	{"user_points", "balance"},
+	{"point_txs", "amount"},
+	{"pending_ops", "amount"},
+}
+
+var errAmountTypeRounds = errors.New("changing the amount type to bigint rounds the stored amounts")
+
+// setAmountColumnTypes alters the amount columns whose type differs from -amount-type.
+// It is not a migration since the type is chosen per run, and it only alters on a change
+// since the alter rewrites the table under an exclusive lock.
+// Postgres rounds amounts with cents into bigint, so the change from numeric needs empty tables.
+func setAmountColumnTypes(ctx context.Context) error {
+	// format_type has no space after the comma
+	want := strings.ReplaceAll(amountColumnType(), " ", "")
+	for _, c := range amountColumns {
+		var got string
+		err := pgctx.QueryRow(ctx, `
+			select format_type(atttypid, atttypmod)
+			from pg_attribute
+			where attrelid = $1::regclass and attname = $2
+		`, tableName(c.table), c.column).Scan(&got)
+		if err != nil {
+			return err
+		}
+		if got == want {
+			continue
+		}
+
+		if want == "bigint" {
+			var hasRows bool
+			err = pgctx.QueryRow(ctx, tableSQL(`select exists (select 1 from {`+c.table+`})`)).Scan(&hasRows)
+			if err != nil {
+				return err
+			}
+			if hasRows {
+				return fmt.Errorf("%w: %s.%s is %s and has rows, run with -reset to start from empty tables",
+					errAmountTypeRounds, c.table, c.column, got)
+			}
+		}
+
+		slog.Info("changing amount column type", "table", c.table, "column", c.column, "from", got, "to", want)
+		_, err = pgctx.Exec(ctx, tableSQL(`alter table {`+c.table+`} alter column `+c.column+` type {amount_type}`))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyMigration applies m unless it is already recorded.
+func applyMigration(ctx context.Context, m migration) error {
+	return pgctx.RunInTx(ctx, func(ctx context.Context) error {
+		// serializes concurrent runs against the same db, so each migration is applied once
+		_, err := pgctx.Exec(ctx, tableSQL(`lock table {schema_migrations} in exclusive mode`))
+		if err != nil {
+			return err
+		}
+
+		var applied bool
+		err = pgctx.QueryRow(ctx, tableSQL(`
+			select exists (select 1 from {schema_migrations} where version = $1)
+		`), m.version).Scan(&applied)
+		if err != nil {
+			return err
+		}
+		if applied {
+			return nil
+		}
+
+		_, err = pgctx.Exec(ctx, tableSQL(m.sql))
+		if err != nil {
+			return err
+		}
+		_, err = pgctx.Exec(ctx, tableSQL(`
+			insert into {schema_migrations} (version, name)
+			values ($1, $2)
+		`), m.version, m.name)
+		if err != nil {
+			return err
+		}
+
+		pgctx.Committed(ctx, func(context.Context) {
+			slog.Info("applied migration", "version", m.version, "name", m.name)
+		})
+		return nil
+	})
+}
+
+// resetTables truncates user_points, point_txs and pending_ops of the db in ctx, if they exist,
+// the pending ops of a reset ledger must not be replayed onto it.
+func resetTables(ctx context.Context) error {
+	_, err := pgctx.Exec(ctx, tableSQL(`
+		do $$
+		begin
+		    truncate table {user_points}, {point_txs}, {pending_ops};
+		exception when undefined_table then
+		end $$;
+	`))
+	if err != nil {
+		return err
+	}
+	resetBalanceCache()
+	return nil
+}
+
+// canTruncate reports whether the tables of the db in ctx may be truncated between load tests,
+// either -truncate is set or the database is named like a test db.
+func canTruncate(ctx context.Context) (bool, error) {
+	if *allowTruncate {
+		return true, nil
+	}
+
+	var name string
+	err := pgctx.QueryRow(ctx, `select current_database()`).Scan(&name)
+	if err != nil {
+		return false, err
+	}
+	name = strings.ToLower(name)
+	return strings.Contains(name, "test") || strings.Contains(name, "bench"), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"hash/fnv"
+	"log/slog"
+
+	"golang.org/x/sync/errgroup"
+)
+
+var flushParallel = flag.Int("flush-parallel", 0, "after the batch load test, rerun it flushing each batch as this many concurrent per-user transactions, 0 disables")
+
+// newParallelPointFlush returns a flush func that splits a batch by user into n groups
+// and applies every group in its own transaction, n at a time.
+// The ops of a user stay in one group in submit order,
+// a failed group fails only its own ops and the rest of the batch commits.
+func newParallelPointFlush(store pointsStore, n int) flushFunc {
+	// a flush func per group, each reuses its own buffers
+	groupFlushes := make([]flushFunc, n)
+	for i := range groupFlushes {
+		groupFlushes[i] = newPointFlush(store)
+	}
+
+	groups := make([][]op, n)
+	// index in buff of every op in groups
+	indexes := make([][]int, n)
+
+	return func(ctx context.Context, buff []op) error {
+		for g := range groups {
+			groups[g] = groups[g][:0]
+			indexes[g] = indexes[g][:0]
+		}
+		for i, p := range buff {
+			g := flushGroupOf(p.userID, n)
+			groups[g] = append(groups[g], p)
+			indexes[g] = append(indexes[g], i)
+		}
+
+		var eg errgroup.Group
+		eg.SetLimit(n)
+		for g := range groups {
+			g := g
+			if len(groups[g]) == 0 {
+				continue
+			}
+			eg.Go(func() error {
+				err := groupFlushes[g](ctx, groups[g])
+				if err != nil {
+					slog.Error("flush group error", "group_size", len(groups[g]), "error", err)
+				}
+				// groups are disjoint, so every goroutine writes different ops of buff
+				for j, i := range indexes[g] {
+					if err != nil {
+						buff[i].result = callback{err: err}
+						continue
+					}
+					// done is nil when the group flush already delivered the result
+					buff[i].result = groups[g][j].result
+					buff[i].done = groups[g][j].done
+				}
+				return nil
+			})
+		}
+		return eg.Wait()
+	}
+}
+
+// flushGroupOf returns the flush group of the user,
+// from the high bits of the hash since shardOf already split users by the low bits.
+func flushGroupOf(userID string, n int) int {
+	h := fnv.New64a()
+	h.Write([]byte(userID))
+	return int((h.Sum64() >> 32) % uint64(n))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var amountType = flag.String("amount-type", "bigint", "column type of balances and amounts, bigint stores whole points, "+
+	"numeric stores numeric(20, 2) and generates amounts with cents")
+
+// Points is a fixed-point amount of points in hundredths, Points(1050) is 10.50 points.
+//
+// Amounts are never rounded implicitly, a value with more precision than the scale
+// or a fraction stored into a bigint column is an error, round before converting.
+type Points int64
+
+// pointsScale is the number of Points in a whole point.
+const pointsScale Points = 100
+
+var errPointsPrecision = errors.New("points: value exceeds the precision of the amount type")
+
+// validateAmountType checks -amount-type, it must be called after flag.Parse.
+func validateAmountType() error {
+	if *amountType != "bigint" && *amountType != "numeric" {
+		return fmt.Errorf("unknown amount type %q", *amountType)
+	}
+	return nil
+}
+
+// amountColumnType returns the sql type of balance and amount columns for -amount-type.
+func amountColumnType() string {
+	if *amountType == "numeric" {
+		return "numeric(20, 2)"
+	}
+	return "bigint"
+}
+
+// String formats p as a decimal with 2 fraction digits.
+func (p Points) String() string {
+	sign := ""
+	v := int64(p)
+	if v < 0 {
+		sign = "-"
+		v = -v
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, v/int64(pointsScale), v%int64(pointsScale))
+}
+
+// MarshalJSON encodes p as a decimal number.
+func (p Points) MarshalJSON() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// Value binds p as a decimal for numeric columns, or as whole points for bigint columns.
+func (p Points) Value() (driver.Value, error) {
+	if *amountType == "numeric" {
+		return p.String(), nil
+	}
+	if p%pointsScale != 0 {
+		return nil, fmt.Errorf("%w: %s is not whole points", errPointsPrecision, p)
+	}
+	return int64(p / pointsScale), nil
+}
+
+// Scan reads a bigint as whole points, or a numeric as its decimal text.
+func (p *Points) Scan(src any) error {
+	switch v := src.(type) {
+	case int64:
+		*p = Points(v) * pointsScale
+		return nil
+	case []byte:
+		return p.parse(string(v))
+	case string:
+		return p.parse(v)
+	default:
+		return fmt.Errorf("points: can not scan %T", src)
+	}
+}
+
+// parse parses a decimal, it fails instead of rounding when s has more than 2 fraction digits.
+func (p *Points) parse(s string) error {
+	whole, frac, _ := strings.Cut(s, ".")
+	neg := strings.HasPrefix(whole, "-")
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > 2 {
+		return fmt.Errorf("%w: %s", errPointsPrecision, s)
+	}
+
+	w, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return fmt.Errorf("points: %w", err)
+	}
+	var f int64
+	if frac != "" {
+		f, err = strconv.ParseInt(frac+strings.Repeat("0", 2-len(frac)), 10, 64)
+		if err != nil {
+			return fmt.Errorf("points: %w", err)
+		}
+	}
+	if neg {
+		f = -f
+	}
+	*p = Points(w)*pointsScale + Points(f)
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"time"
+)
+
+// poolDBs are the dbs whose connection pools are reported per load test, set by main.
+var poolDBs []*sql.DB
+
+// poolStats is the connection pool usage during a load test, summed over poolDBs.
+type poolStats struct {
+	// waitCount and waitDuration are the waits for a free connection
+	waitCount    int64
+	waitDuration time.Duration
+
+	maxOpen   int
+	peakInUse int
+}
+
+// watchPoolStats samples the pools of poolDBs until ctx is done,
+// stats returns the usage since the call.
+func watchPoolStats(ctx context.Context) (stats func() poolStats) {
+	before := make([]sql.DBStats, len(poolDBs))
+	for i, db := range poolDBs {
+		before[i] = db.Stats()
+	}
+
+	var peak atomic.Int64
+	sample := func() {
+		var inUse int64
+		for _, db := range poolDBs {
+			inUse += int64(db.Stats().InUse)
+		}
+		if inUse > peak.Load() {
+			peak.Store(inUse)
+		}
+	}
+	sample()
+
+	go func() {
+		// InUse is a point in time value, sample often enough to catch the peak
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				sample()
+			}
+		}
+	}()
+
+	return func() poolStats {
+		var s poolStats
+		for i, db := range poolDBs {
+			after := db.Stats()
+			s.waitCount += after.WaitCount - before[i].WaitCount
+			s.waitDuration += after.WaitDuration - before[i].WaitDuration
+			s.maxOpen += after.MaxOpenConnections
+		}
+		s.peakInUse = int(peak.Load())
+		return s
+	}
+}
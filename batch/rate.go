@@ -0,0 +1,43 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rollingRate counts events into per-second buckets of a ring buffer
+// to report the rate over the last len(buckets) seconds.
+type rollingRate struct {
+	mu      sync.Mutex
+	buckets [10]uint64
+	secs    [10]int64
+}
+
+func (r *rollingRate) add(n int, now time.Time) {
+	sec := now.Unix()
+	i := sec % int64(len(r.buckets))
+
+	r.mu.Lock()
+	if r.secs[i] != sec {
+		r.secs[i] = sec
+		r.buckets[i] = 0
+	}
+	r.buckets[i] += uint64(n)
+	r.mu.Unlock()
+}
+
+// rate returns events per second over the window ending at now.
+func (r *rollingRate) rate(now time.Time) float64 {
+	sec := now.Unix()
+	window := int64(len(r.buckets))
+
+	var sum uint64
+	r.mu.Lock()
+	for i, s := range r.secs {
+		if sec-s < window {
+			sum += r.buckets[i]
+		}
+	}
+	r.mu.Unlock()
+	return float64(sum) / float64(window)
+}
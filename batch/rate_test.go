@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRollingRate(t *testing.T) {
+	var r rollingRate
+	t0 := time.Unix(1000, 0)
+	at := func(d time.Duration) time.Time { return t0.Add(d) }
+
+	r.add(100, at(0))
+	r.add(200, at(time.Second))
+	r.add(300, at(2500*time.Millisecond))
+
+	tests := []struct {
+		now  time.Duration
+		want float64
+	}{
+		{2500 * time.Millisecond, 60},
+		{9 * time.Second, 60},
+		// the bucket of t0 left the window
+		{10 * time.Second, 50},
+		{11 * time.Second, 30},
+		{12 * time.Second, 0},
+	}
+	for _, tt := range tests {
+		if got := r.rate(at(tt.now)); got != tt.want {
+			t.Errorf("rate at +%v = %v, want %v", tt.now, got, tt.want)
+		}
+	}
+
+	// a new second reuses the ring slot of the second it replaces
+	r.add(50, at(10*time.Second))
+	if got := r.rate(at(10 * time.Second)); got != 55 {
+		t.Errorf("rate after the slot is reused = %v, want 55", got)
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"errors"
+	"flag"
+
+	"ncd2023/internal/ratelimit"
+)
+
+var (
+	userRate  = flag.Float64("user-rate", 0, "batch ops per second allowed per user before failing with rate limited, 0 disables")
+	userBurst = flag.Int("user-burst", 10, "batch ops a user may submit at once above -user-rate")
+)
+
+var errRateLimited = errors.New("rate limited")
+
+// userLimiter is the per user limiter of batch ops, set by main when -user-rate is set
+var userLimiter *ratelimit.Limiter
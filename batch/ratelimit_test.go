@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"ncd2023/internal/ratelimit"
+)
+
+// a limited user is rejected before its op is queued, other users still get through
+func TestAddPointBatchRateLimited(t *testing.T) {
+	startMemShards(t, newMemStore(nil))
+	prev := userLimiter
+	// no token refills within the test
+	userLimiter = ratelimit.New(0.001, 2, 0)
+	t.Cleanup(func() { userLimiter = prev })
+
+	for i := 0; i < 2; i++ {
+		_, err := addPointBatch(context.Background(), "hot", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := addPointBatch(context.Background(), "hot", 1)
+	if !errors.Is(err, errRateLimited) {
+		t.Fatalf("got error %v, want %v", err, errRateLimited)
+	}
+	_, err = addPointBatch(context.Background(), "other", 1)
+	if err != nil {
+		t.Errorf("other user: %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/acoshift/pgsql/pgctx"
+)
+
+var rebuild = flag.Bool("rebuild", false, "rebuild user_points from the point_txs ledger of every db then exit, without running the benchmark")
+
+// rebuildBalances replaces user_points with the balances summed from point_txs,
+// the ledger is the source of truth for balances.
+func rebuildBalances(ctx context.Context) error {
+	return pgctx.RunInTx(ctx, func(ctx context.Context) error {
+		_, err := pgctx.Exec(ctx, tableSQL(`
+			truncate table {user_points}
+		`))
+		if err != nil {
+			return err
+		}
+
+		_, err = pgctx.Exec(ctx, tableSQL(`
+			insert into {user_points} (user_id, balance)
+			select user_id, sum(amount)
+			from {point_txs}
+			group by user_id
+		`))
+		return err
+	})
+}
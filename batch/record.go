@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// recorder writes every operation and its outcome as a tab separated line,
+// sort the file to diff runs since operations complete concurrently.
+type recorder struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+func newRecorder(name string) (*recorder, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (r *recorder) record(phase string, user int, amount Points, res pointResult, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		fmt.Fprintf(r.w, "%s\t%d\t%s\terror\t%v\n", phase, user, amount, err)
+		return
+	}
+	fmt.Fprintf(r.w, "%s\t%d\t%s\tok\t%s\t%t\n", phase, user, amount, res.balance, res.created)
+}
+
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.w.Flush()
+	if err != nil {
+		r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
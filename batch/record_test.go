@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// memAddPoint returns an add point applying a single op to store, like the direct path.
+func memAddPoint(store *memStore) addPointFunc {
+	return func(ctx context.Context, userID string, amount Points) (pointResult, error) {
+		ops := []op{{userID: userID, amount: amount}}
+		err := store.RunInTx(ctx, func(ctx context.Context) error {
+			state, err := store.Balances(ctx, []string{userID})
+			if err != nil {
+				return err
+			}
+			dirty, txLogs := applyPointOps(ops, state, txIDUUID, nil)
+			return writePointOps(ctx, store, ops, txIDUUID, txLogs, dirty)
+		})
+		if err != nil {
+			return pointResult{}, err
+		}
+		return ops[0].result.result, ops[0].result.err
+	}
+}
+
+// recordRun records 200 ops of 3 users run one at a time from seed and returns the recording.
+func recordRun(t *testing.T, seed int64) []byte {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ops.tsv")
+	rec, err := newRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opRecorder = rec
+	defer func() { opRecorder = nil }()
+
+	add := memAddPoint(newMemStore(nil))
+	rnd := rand.New(rand.NewSource(seed))
+	for i := 0; i < 200; i++ {
+		runOp(context.Background(), "direct", i%3, fmt.Sprintf("user-%d", i%3), rnd, add)
+	}
+
+	err = rec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRecordSameSeed(t *testing.T) {
+	setFlag(t, "debit-ratio", "0.4")
+
+	a, b := recordRun(t, 1), recordRun(t, 1)
+	if !bytes.Equal(a, b) {
+		t.Fatalf("recordings of the same seed differ:\n%s\n%s", a, b)
+	}
+	if n := bytes.Count(a, []byte("\n")); n != 200 {
+		t.Errorf("recorded %d ops, want 200", n)
+	}
+	if !bytes.Contains(a, []byte("\terror\t"+errInsufficientBalance.Error())) {
+		t.Errorf("no rejected debit recorded, the recording does not cover errors")
+	}
+
+	if c := recordRun(t, 2); bytes.Equal(a, c) {
+		t.Errorf("recordings of different seeds are identical")
+	}
+}
+
+// the priority ops of -priority-ratio come from the worker rand, so a seed picks the same ones
+func TestRunOpPrioritySeeded(t *testing.T) {
+	setFlag(t, "priority-ratio", "0.5")
+
+	run := func(seed int64) []bool {
+		var priorities []bool
+		add := func(ctx context.Context, userID string, amount Points) (pointResult, error) {
+			priorities = append(priorities, isPriority(ctx))
+			return pointResult{}, nil
+		}
+		rnd := rand.New(rand.NewSource(seed))
+		for i := 0; i < 100; i++ {
+			runOp(context.Background(), "batch", 0, "user", rnd, add)
+		}
+		return priorities
+	}
+
+	first := run(1)
+	if !slices.Equal(first, run(1)) {
+		t.Error("the same seed picked other priority ops")
+	}
+	n := 0
+	for _, priority := range first {
+		if priority {
+			n++
+		}
+	}
+	if n == 0 || n == len(first) {
+		t.Errorf("%d of %d ops priority, want about half", n, len(first))
+	}
+}
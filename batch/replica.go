@@ -0,0 +1,20 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/acoshift/pgsql/pgctx"
+)
+
+// replicaDB serves the leaderboard and balance reads when REPLICA_DB_URL is set, nil sends them to the primary
+var replicaDB *sql.DB
+
+// readCtx routes the queries of ctx to the replica, writes must keep using ctx.
+// Queries of a tx in ctx stay in the tx.
+func readCtx(ctx context.Context) context.Context {
+	if replicaDB == nil {
+		return ctx
+	}
+	return pgctx.NewContext(ctx, replicaDB)
+}
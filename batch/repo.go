@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/acoshift/pgsql"
+	"github.com/acoshift/pgsql/pgctx"
+	"github.com/acoshift/pgsql/pgstmt"
+)
+
+// PointsRepo runs the point queries on the db or tx of the context,
+// shared by the non batch and batch paths.
+type PointsRepo struct{}
+
+var pointsRepo PointsRepo
+
+// pointsStore is the storage of the batch flush, the db or tx is carried by ctx.
+// PointsRepo stores in postgres, an in-memory store runs the flush logic without a db.
+type pointsStore interface {
+	// RunInTx runs f in a transaction, the writes of f are discarded when it fails
+	// or returns pgsql.ErrAbortTx, which is not an error of RunInTx.
+	RunInTx(ctx context.Context, f func(ctx context.Context) error) error
+
+	Balances(ctx context.Context, userIDs []string) (map[string]Points, error)
+	UpsertBalances(ctx context.Context, balances map[string]Points) error
+	InsertTxs(ctx context.Context, ids txIDStrategy, txLogs []txLog) error
+}
+
+// RunInTx runs f in a transaction of the db in ctx.
+func (PointsRepo) RunInTx(ctx context.Context, f func(ctx context.Context) error) error {
+	return pgctx.RunInTx(ctx, f)
+}
+
+// Balance returns the balance of the user, ok is false when the user has no balance.
+func (PointsRepo) Balance(ctx context.Context, userID string) (balance Points, ok bool, err error) {
+	err = pgctx.QueryRow(ctx, tableSQL(`
+		select balance
+		from {user_points}
+		where user_id = $1
+	`), userID).Scan(&balance)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return balance, true, nil
+}
+
+// Balances returns the balances of userIDs, users without a balance are not in the result.
+func (PointsRepo) Balances(ctx context.Context, userIDs []string) (map[string]Points, error) {
+	m := map[string]Points{}
+	if len(userIDs) == 0 {
+		return m, nil
+	}
+
+	// user ids are sent as a single array parameter,
+	// guard on the key count anyway in case the query is changed to bind each id
+	err := checkQueryParams("balances", len(userIDs))
+	if err != nil {
+		return nil, err
+	}
+
+	err = pgctx.Iter(ctx, func(scan pgsql.Scanner) error {
+		var (
+			userID  string
+			balance Points
+		)
+		err := scan(&userID, &balance)
+		if err != nil {
+			return err
+		}
+		m[userID] = balance
+		return nil
+	}, tableSQL(`
+		select user_id, balance
+		from {user_points}
+		where user_id = any($1)
+	`), dbDriver.array(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// maxTxIDAttempts is the number of times InsertTxs inserts the tx logs whose generated id collided.
+const maxTxIDAttempts = 3
+
+var errTxIDCollision = errors.New("point tx id collision")
+
+// InsertTxs appends tx logs to point_txs, ids must be the strategy the tx ids were generated with.
+//
+// A tx log whose generated id collides with an existing tx is skipped by the insert
+// and inserted again with a new id instead of failing every op of the batch, the ids of txLogs are replaced.
+// Tx logs copied in from -copy-threshold still fail on a collision.
+func (PointsRepo) InsertTxs(ctx context.Context, ids txIDStrategy, txLogs []txLog) error {
+	if len(txLogs) == 0 {
+		return nil
+	}
+	if *copyThreshold > 0 && len(txLogs) >= *copyThreshold {
+		return copyTxLogs(ctx, ids, txLogs)
+	}
+	if ids == txIDSerial {
+		// the insert generates the ids, they never collide
+		_, err := insertTxs(ctx, ids, txLogs)
+		return err
+	}
+
+	pending := make([]int, len(txLogs))
+	for i := range pending {
+		pending[i] = i
+	}
+	for attempt := 1; ; attempt++ {
+		batch := make([]txLog, len(pending))
+		for i, k := range pending {
+			batch[i] = txLogs[k]
+		}
+		inserted, err := insertTxs(ctx, ids, batch)
+		if err != nil {
+			return err
+		}
+
+		// an id is returned once per inserted row, a duplicate within the batch is inserted once
+		missing := pending[:0]
+		for _, k := range pending {
+			if inserted[txLogs[k].txID] > 0 {
+				inserted[txLogs[k].txID]--
+				continue
+			}
+			missing = append(missing, k)
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+		if attempt == maxTxIDAttempts {
+			return fmt.Errorf("%w: %d tx logs after %d attempts", errTxIDCollision, len(missing), attempt)
+		}
+
+		slog.Warn("point tx id collision, retrying with new ids", "tx_logs", len(missing), "attempt", attempt)
+		for _, k := range missing {
+			txLogs[k].txID = ids.newID()
+		}
+		pending = missing
+	}
+}
+
+// insertTxs inserts txLogs and returns the number of rows inserted for each generated id,
+// serial ids are generated by the insert and not returned.
+func insertTxs(ctx context.Context, ids txIDStrategy, txLogs []txLog) (map[string]int, error) {
+	inserted := make(map[string]int, len(txLogs))
+
+	// stay under the bind parameter limit, 3 parameters per row
+	for _, chunk := range chunkSlice(txLogs, maxQueryParams/3) {
+		stmt := insertTxLogsStmt(ids, chunk)
+		if ids == txIDSerial {
+			_, err := stmt.ExecWith(ctx)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		err := stmt.IterWith(ctx, func(scan pgsql.Scanner) error {
+			var id string
+			err := scan(&id)
+			if err != nil {
+				return err
+			}
+			inserted[id]++
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return inserted, nil
+}
+
+// UpsertBalances stores the balance of every user in balances,
+// replacing the stored balances.
+func (PointsRepo) UpsertBalances(ctx context.Context, balances map[string]Points) error {
+	if len(balances) == 0 {
+		return nil
+	}
+
+	// stay under the bind parameter limit, 2 parameters per row
+	for _, userIDs := range chunkSlice(sortedUserIDs(balances), maxQueryParams/2) {
+		_, err := upsertBalancesStmt(upsertReplace, balances, userIDs).ExecWith(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IncrementBalance adds delta to the stored balance of the user
+// and returns the new balance, created is true when the user had no balance.
+// An overdraw fails the balance check constraint and returns errInsufficientBalance.
+func (PointsRepo) IncrementBalance(ctx context.Context, userID string, delta Points) (balance Points, created bool, err error) {
+	err = pgstmt.Insert(func(b pgstmt.InsertStatement) {
+		b.Into(tableName("user_points"))
+		b.Columns("user_id", "balance")
+		b.Value(userID, delta)
+		onBalanceConflict(b, upsertIncrement)
+		// xmax is 0 only for a newly inserted row
+		b.Returning("balance", "xmax = 0")
+	}).QueryRowWith(ctx).Scan(&balance, &created)
+	if isBalanceCheckViolation(err) {
+		return 0, false, errInsufficientBalance
+	}
+	return balance, created, err
+}
+
+// isBalanceCheckViolation reports whether err is a check_violation of the user_points balance check constraint.
+func isBalanceCheckViolation(err error) bool {
+	code, constraint, ok := dbDriver.errorCode(err)
+	return ok && code == "23514" && constraint == *tablePrefix+"user_points_balance_check"
+}
+
+// Tx is a point_txs ledger entry.
+type Tx struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"userId"`
+	Amount    Points    `json:"amount"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// recentTxs returns the latest limit transactions of the user, newest first.
+func recentTxs(ctx context.Context, userID string, limit int) ([]Tx, error) {
+	var txs []Tx
+	err := pgctx.Iter(ctx, func(scan pgsql.Scanner) error {
+		var tx Tx
+		err := scan(&tx.ID, &tx.UserID, &tx.Amount, &tx.CreatedAt)
+		if err != nil {
+			return err
+		}
+		txs = append(txs, tx)
+		return nil
+	}, tableSQL(`
+		select id, user_id, amount, created_at
+		from {point_txs}
+		where user_id = $1
+		order by created_at desc
+		limit $2
+	`), userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return txs, nil
+}
+
+// getBalances returns the balance of every user in userIDs from a single query,
+// a user without a balance has 0 like in addPoint.
+func getBalances(ctx context.Context, userIDs []string) (map[string]Points, error) {
+	m, err := pointsRepo.Balances(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, userID := range userIDs {
+		if _, ok := m[userID]; !ok {
+			m[userID] = 0
+		}
+	}
+	return m, nil
+}
+
+// UserBalance is the balance of a user.
+type UserBalance struct {
+	UserID  string `json:"userId"`
+	Balance Points `json:"balance"`
+}
+
+// topUsers returns the limit users with the highest balance, highest first.
+func topUsers(ctx context.Context, limit int) ([]UserBalance, error) {
+	var users []UserBalance
+	err := pgctx.Iter(ctx, func(scan pgsql.Scanner) error {
+		var u UserBalance
+		err := scan(&u.UserID, &u.Balance)
+		if err != nil {
+			return err
+		}
+		users = append(users, u)
+		return nil
+	}, tableSQL(`
+		select user_id, balance
+		from {user_points}
+		order by balance desc
+		limit $1
+	`), limit)
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// insertTxLogsStmt builds the statement that inserts all tx logs in one round trip,
+// a generated id that already exists is skipped and the ids inserted are returned.
+func insertTxLogsStmt(ids txIDStrategy, txLogs []txLog) *pgstmt.Result {
+	return pgstmt.Insert(func(b pgstmt.InsertStatement) {
+		b.Into(tableName("point_txs"))
+		if ids == txIDSerial {
+			b.Columns("user_id", "amount")
+			for _, tx := range txLogs {
+				b.Value(tx.userID, tx.amount)
+			}
+			return
+		}
+
+		b.Columns("id", "user_id", "amount")
+		for _, tx := range txLogs {
+			b.Value(tx.txID, tx.userID, tx.amount)
+		}
+		b.OnConflict("id").DoNothing()
+		b.Returning("id")
+	})
+}
+
+// copyTxLogs inserts tx logs using COPY FROM STDIN, it must be called inside a tx.
+func copyTxLogs(ctx context.Context, ids txIDStrategy, txLogs []txLog) error {
+	columns := []string{"id", "user_id", "amount"}
+	if ids == txIDSerial {
+		columns = columns[1:]
+	}
+
+	rows := make([][]any, 0, len(txLogs))
+	for _, tx := range txLogs {
+		if ids == txIDSerial {
+			rows = append(rows, []any{tx.userID, tx.amount})
+		} else {
+			rows = append(rows, []any{tx.txID, tx.userID, tx.amount})
+		}
+	}
+	return dbDriver.copyIn(ctx, *tablePrefix+"point_txs", columns, rows)
+}
+
+// sortedUserIDs returns the users of balances sorted,
+// so the generated statements are stable for the same input.
+func sortedUserIDs(balances map[string]Points) []string {
+	userIDs := make([]string, 0, len(balances))
+	for userID := range balances {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+	return userIDs
+}
+
+// balanceUpsert is how an upsert combines the stored balance of a user with the inserted value.
+// Every balance upsert goes through onBalanceConflict,
+// so a statement either replaces or increments, never both.
+type balanceUpsert int
+
+const (
+	// upsertReplace overwrites the stored balance,
+	// the value is a balance computed from a read in the same tx
+	upsertReplace balanceUpsert = iota
+
+	// upsertIncrement adds the value to the stored balance,
+	// the value is a delta and no read is needed
+	upsertIncrement
+)
+
+// onBalanceConflict sets the conflict clause of a user_points insert for mode.
+func onBalanceConflict(b pgstmt.InsertStatement, mode balanceUpsert) {
+	b.OnConflict("user_id").DoUpdate(func(b pgstmt.UpdateStatement) {
+		switch mode {
+		case upsertReplace:
+			b.Set("balance").ToRaw("excluded.balance")
+		case upsertIncrement:
+			b.Set("balance").ToRaw(tableName("user_points") + ".balance + excluded.balance")
+		default:
+			panic(fmt.Sprintf("unknown balance upsert %d", mode))
+		}
+	})
+}
+
+// upsertBalancesStmt builds the upsert statement for the balances of userIDs.
+func upsertBalancesStmt(mode balanceUpsert, balances map[string]Points, userIDs []string) *pgstmt.Result {
+	return pgstmt.Insert(func(b pgstmt.InsertStatement) {
+		b.Into(tableName("user_points"))
+		b.Columns("user_id", "balance")
+		for _, userID := range userIDs {
+			b.Value(userID, balances[userID])
+		}
+		onBalanceConflict(b, mode)
+	})
+}
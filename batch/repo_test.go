@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/acoshift/pgsql/pgstmt"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of the generated statements")
+
+// assertGolden compares the query and args of stmt with testdata/name.golden.
+func assertGolden(t *testing.T, name string, stmt *pgstmt.Result) {
+	t.Helper()
+	query, args := stmt.SQL()
+	var b strings.Builder
+	b.WriteString(query)
+	b.WriteString("\n")
+	for i, arg := range args.([]any) {
+		fmt.Fprintf(&b, "$%d = %v\n", i+1, arg)
+	}
+	got := b.String()
+
+	path := filepath.Join("testdata", name+".golden")
+	if *updateGolden {
+		err := os.WriteFile(path, []byte(got), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("%s changed, run go test -update if intended\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+// goldenTxLogs returns n tx logs with fixed ids.
+func goldenTxLogs(n int) []txLog {
+	txLogs := make([]txLog, n)
+	for i := range txLogs {
+		txLogs[i] = txLog{
+			txID:   fmt.Sprintf("00000000-0000-0000-0000-%012d", i+1),
+			userID: fmt.Sprintf("user-%d", i%2),
+			amount: Points((i + 1) * 100),
+		}
+	}
+	return txLogs
+}
+
+func TestInsertTxLogsStmtGolden(t *testing.T) {
+	for _, n := range []int{1, 3} {
+		assertGolden(t, fmt.Sprintf("insert_tx_logs_%d", n), insertTxLogsStmt(txIDUUID, goldenTxLogs(n)))
+		assertGolden(t, fmt.Sprintf("insert_tx_logs_serial_%d", n), insertTxLogsStmt(txIDSerial, goldenTxLogs(n)))
+	}
+}
+
+func TestUpsertBalancesStmtGolden(t *testing.T) {
+	for _, n := range []int{1, 3} {
+		balances := make(map[string]Points, n)
+		for i := 0; i < n; i++ {
+			balances[fmt.Sprintf("user-%d", i)] = Points(i * 150)
+		}
+		userIDs := sortedUserIDs(balances)
+		assertGolden(t, fmt.Sprintf("upsert_balances_replace_%d", n), upsertBalancesStmt(upsertReplace, balances, userIDs))
+		assertGolden(t, fmt.Sprintf("upsert_balances_increment_%d", n), upsertBalancesStmt(upsertIncrement, balances, userIDs))
+	}
+}
+
+func TestBalancesTooManyKeys(t *testing.T) {
+	userIDs := make([]string, maxQueryParams+1)
+	for i := range userIDs {
+		userIDs[i] = fmt.Sprintf("user-%d", i)
+	}
+
+	// fails before the query, so no db is needed
+	_, err := pointsRepo.Balances(context.Background(), userIDs)
+	var qerr *queryParamsError
+	if !errors.As(err, &qerr) {
+		t.Fatalf("got error %v, want a queryParamsError", err)
+	}
+	if qerr.Query != "balances" || qerr.Count != len(userIDs) {
+		t.Errorf("got %+v, want the balances query with %d keys", qerr, len(userIDs))
+	}
+}
+
+// every balance upsert either replaces or increments the stored balance, never both
+func TestOnBalanceConflict(t *testing.T) {
+	const (
+		replace   = `set balance = excluded.balance`
+		increment = `set balance = "user_points".balance + excluded.balance`
+	)
+	balances := map[string]Points{"a": 10}
+	tests := []struct {
+		mode      balanceUpsert
+		want, not string
+	}{
+		{upsertReplace, replace, increment},
+		{upsertIncrement, increment, replace},
+	}
+	for _, tt := range tests {
+		query, _ := upsertBalancesStmt(tt.mode, balances, []string{"a"}).SQL()
+		if strings.Count(query, "excluded.balance") != 1 || !strings.Contains(query, tt.want) || strings.Contains(query, tt.not) {
+			t.Errorf("upsert %d: %s, want exactly %q", tt.mode, query, tt.want)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("unknown upsert mode did not panic")
+		}
+	}()
+	upsertBalancesStmt(balanceUpsert(-1), balances, []string{"a"}).SQL()
+}
+
+func TestIsBalanceCheckViolation(t *testing.T) {
+	prev := dbDriver
+	t.Cleanup(func() { dbDriver = prev })
+
+	constraint := *tablePrefix + "user_points_balance_check"
+	tests := []struct {
+		driver sqlDriver
+		err    func(code, constraint string) error
+	}{
+		{pqDriver{}, func(code, constraint string) error {
+			return &pq.Error{Code: pq.ErrorCode(code), Constraint: constraint}
+		}},
+		{pgxDriver{}, func(code, constraint string) error {
+			return &pgconn.PgError{Code: code, ConstraintName: constraint}
+		}},
+	}
+	for _, tt := range tests {
+		dbDriver = tt.driver
+		if !isBalanceCheckViolation(fmt.Errorf("upsert: %w", tt.err("23514", constraint))) {
+			t.Errorf("%T: balance check violation not detected", tt.driver)
+		}
+		if isBalanceCheckViolation(tt.err("23514", "other_check")) {
+			t.Errorf("%T: another check constraint taken for the balance check", tt.driver)
+		}
+		if isBalanceCheckViolation(tt.err("23505", constraint)) {
+			t.Errorf("%T: a unique violation taken for the balance check", tt.driver)
+		}
+		if isBalanceCheckViolation(errors.New("23514")) {
+			t.Errorf("%T: a non postgres error taken for the balance check", tt.driver)
+		}
+	}
+}
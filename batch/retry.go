@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"flag"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// add point retry
+var (
+	retryAttempts = flag.Int("retry-attempts", 1, "maximum attempts of a non batch add point on transient errors, 1 disables retries")
+	retryBackoff  = flag.Duration("retry-backoff", 10*time.Millisecond, "backoff before the first retry, doubled on every next retry")
+)
+
+// withRetry calls fn up to maxAttempts times while it fails with a transient error,
+// sleeping baseBackoff before the first retry and doubling it after each one.
+// Other errors, including errInsufficientBalance, are returned right away.
+func withRetry[T any](ctx context.Context, fn func(ctx context.Context) (T, error), maxAttempts int, baseBackoff time.Duration) (T, error) {
+	backoff := baseBackoff
+	for attempt := 1; ; attempt++ {
+		r, err := fn(ctx)
+		if err == nil || attempt >= maxAttempts || !isTransientError(err) {
+			return r, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return r, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// isTransientError reports whether err may succeed when the op is retried.
+// Only errors that leave the tx surely not committed are retried: a failure postgres rolled back,
+// or a connection that never reached the server. A connection lost mid tx, e.g. during the commit,
+// may have committed the op, retrying it would apply it twice.
+func isTransientError(err error) bool {
+	switch {
+	// database/sql returns ErrBadConn only before the query was sent
+	case errors.Is(err, driver.ErrBadConn),
+		errors.Is(err, syscall.ECONNREFUSED):
+		return true
+	case isErrorCode(err, "40001"), // serialization_failure
+		isErrorCode(err, "40P01"): // deadlock_detected
+		return true
+	}
+	return false
+}
+
+// retryAddPoint wraps add with withRetry using the retry flags,
+// ops that succeed after a retry are counted in retriedCnt
+// and retries after a serialization failure in serializationRetryCnt.
+func retryAddPoint(add addPointFunc) addPointFunc {
+	return func(ctx context.Context, userID string, amount Points) (pointResult, error) {
+		var (
+			attempts int
+			lastErr  error
+		)
+		res, err := withRetry(ctx, func(ctx context.Context) (pointResult, error) {
+			if isErrorCode(lastErr, "40001") {
+				atomic.AddUint64(&serializationRetryCnt, 1)
+			}
+			attempts++
+			res, err := add(ctx, userID, amount)
+			lastErr = err
+			return res, err
+		}, *retryAttempts, *retryBackoff)
+		if err == nil && attempts > 1 {
+			atomic.AddUint64(&retriedCnt, 1)
+		}
+		return res, err
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+)
+
+func TestIsTransientError(t *testing.T) {
+	prev := dbDriver
+	t.Cleanup(func() { dbDriver = prev })
+
+	dialErr := &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	readErr := &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	tests := []struct {
+		driver sqlDriver
+		err    func(code string) error
+	}{
+		{pqDriver{}, func(code string) error { return &pq.Error{Code: pq.ErrorCode(code)} }},
+		{pgxDriver{}, func(code string) error { return &pgconn.PgError{Code: code} }},
+	}
+	for _, tt := range tests {
+		dbDriver = tt.driver
+		for _, err := range []error{
+			tt.err("40001"),
+			tt.err("40P01"),
+			fmt.Errorf("add point: %w", tt.err("40001")),
+			driver.ErrBadConn,
+			dialErr,
+		} {
+			if !isTransientError(err) {
+				t.Errorf("%T: %v not retried", tt.driver, err)
+			}
+		}
+
+		// the tx may have committed before the connection was lost
+		for _, err := range []error{
+			tt.err("08006"),
+			tt.err("08003"),
+			readErr,
+			io.ErrUnexpectedEOF,
+			tt.err("23514"),
+			errInsufficientBalance,
+			context.DeadlineExceeded,
+		} {
+			if isTransientError(err) {
+				t.Errorf("%T: %v retried", tt.driver, err)
+			}
+		}
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	serializationFailure := &pq.Error{Code: "40001"}
+
+	calls := 0
+	_, err := withRetry(context.Background(), func(context.Context) (int, error) {
+		calls++
+		if calls < 3 {
+			return 0, serializationFailure
+		}
+		return calls, nil
+	}, 5, 0)
+	if err != nil || calls != 3 {
+		t.Errorf("got %v after %d calls, want success on the third", err, calls)
+	}
+
+	calls = 0
+	_, err = withRetry(context.Background(), func(context.Context) (int, error) {
+		calls++
+		return 0, serializationFailure
+	}, 3, 0)
+	if err != serializationFailure || calls != 3 {
+		t.Errorf("got %v after %d calls, want the failure after 3 attempts", err, calls)
+	}
+
+	// a lost connection may have committed the op, it is not applied a second time
+	calls = 0
+	_, err = withRetry(context.Background(), func(context.Context) (int, error) {
+		calls++
+		return 0, io.ErrUnexpectedEOF
+	}, 3, 0)
+	if err != io.ErrUnexpectedEOF || calls != 1 {
+		t.Errorf("got %v after %d calls, want a single attempt", err, calls)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/acoshift/pgsql"
+	"github.com/acoshift/pgsql/pgctx"
+)
+
+// SnapshotLedger writes all balances and point txs from a single repeatable read snapshot,
+// so balances always match the sum of the txs in the same snapshot.
+//
+// The format is line based and tab separated:
+//
+//	snapshot	<snapshot time RFC3339Nano>
+//	user_points
+//	<user_id>	<balance>
+//	...
+//	point_txs
+//	<id>	<user_id>	<amount>	<created_at RFC3339Nano>
+//	...
+//	end
+//
+// The trailing end line marks a complete snapshot.
+func SnapshotLedger(ctx context.Context, w io.Writer) error {
+	opt := pgsql.TxOptions{
+		TxOptions: sql.TxOptions{
+			Isolation: sql.LevelRepeatableRead,
+			ReadOnly:  true,
+		},
+		// output is streamed, a retry would write it twice
+		MaxAttempts: 1,
+	}
+
+	bw := bufio.NewWriter(w)
+	err := pgctx.RunInTxOptions(ctx, &opt, func(ctx context.Context) error {
+		var snapshotAt time.Time
+		err := pgctx.QueryRow(ctx, `select now()`).Scan(&snapshotAt)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(bw, "snapshot\t%s\n", snapshotAt.UTC().Format(time.RFC3339Nano))
+
+		fmt.Fprintln(bw, "user_points")
+		err = pgctx.Iter(ctx, func(scan pgsql.Scanner) error {
+			var (
+				userID  string
+				balance Points
+			)
+			err := scan(&userID, &balance)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(bw, "%s\t%s\n", userID, balance)
+			return nil
+		}, tableSQL(`
+			select user_id, balance
+			from {user_points}
+			order by user_id
+		`))
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(bw, "point_txs")
+		err = pgctx.Iter(ctx, func(scan pgsql.Scanner) error {
+			var (
+				id        string
+				userID    string
+				amount    Points
+				createdAt time.Time
+			)
+			err := scan(&id, &userID, &amount, &createdAt)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(bw, "%s\t%s\t%s\t%s\n", id, userID, amount, createdAt.UTC().Format(time.RFC3339Nano))
+			return nil
+		}, tableSQL(`
+			select id, user_id, amount, created_at
+			from {point_txs}
+			order by created_at, id
+		`))
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(bw, "end")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
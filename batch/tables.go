@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+var tablePrefix = flag.String("table-prefix", "", "prefix for all table names, lets isolated benchmark variants share a database")
+
+// tableNames are the tables used by the benchmark, queries refer to them as {name}
+var tableNames = []string{"user_points", "point_txs", "pending_ops", "schema_migrations"}
+
+// constraintNames are the named constraints and indexes, prefixed and referred to like tables
+var constraintNames = []string{"user_points_balance_check", "point_txs_user_id_created_at_idx", "user_points_balance_idx"}
+
+var tableReplacer *strings.Replacer
+
+// setupTables applies the table prefix, it must be called after flag.Parse.
+func setupTables() {
+	var oldnew []string
+	for _, name := range append(tableNames, constraintNames...) {
+		oldnew = append(oldnew, "{"+name+"}", tableName(name))
+	}
+	// not a name, the column type of balances and amounts
+	oldnew = append(oldnew, "{amount_type}", amountColumnType())
+	tableReplacer = strings.NewReplacer(oldnew...)
+}
+
+// tableName returns the quoted table name with prefix.
+func tableName(name string) string {
+	return pq.QuoteIdentifier(*tablePrefix + name)
+}
+
+// tableSQL replaces {name} placeholders in query with the table names.
+func tableSQL(query string) string {
+	return tableReplacer.Replace(query)
+}
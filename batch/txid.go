@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/acoshift/pgsql/pgctx"
+	"github.com/google/uuid"
+)
+
+// txIDStrategy is how the batch worker generates point_txs ids,
+// used to compare the primary key index locality.
+type txIDStrategy int32
+
+const (
+	// random uuid, inserts are spread across the whole index
+	txIDUUID txIDStrategy = iota
+
+	// uuid prefixed by unix millis like ulid, inserts append to the index
+	txIDTimeOrdered
+
+	// bigserial generated by postgres
+	txIDSerial
+)
+
+var txIDStrategies = []txIDStrategy{txIDUUID, txIDTimeOrdered, txIDSerial}
+
+// currentTxIDStrategy is read by the batch worker on every flush
+var currentTxIDStrategy atomic.Int32
+
+func getTxIDStrategy() txIDStrategy {
+	return txIDStrategy(currentTxIDStrategy.Load())
+}
+
+func (s txIDStrategy) String() string {
+	switch s {
+	case txIDUUID:
+		return "uuid"
+	case txIDTimeOrdered:
+		return "time ordered uuid"
+	case txIDSerial:
+		return "bigserial"
+	default:
+		return fmt.Sprintf("txIDStrategy(%d)", int32(s))
+	}
+}
+
+// newID returns a new tx id, or an empty string when the database generates it.
+func (s txIDStrategy) newID() string {
+	switch s {
+	case txIDTimeOrdered:
+		return newTimeOrderedUUID()
+	case txIDSerial:
+		return ""
+	default:
+		return uuid.NewString()
+	}
+}
+
+// newTimeOrderedUUID returns a uuid v7, 48 bits unix millis followed by random bits.
+func newTimeOrderedUUID() string {
+	var u uuid.UUID
+	_, err := rand.Read(u[:])
+	if err != nil {
+		return uuid.NewString()
+	}
+
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(time.Now().UnixMilli()))
+	copy(u[:6], ts[2:])
+	u[6] = (u[6] & 0x0f) | 0x70 // version 7
+	u[8] = (u[8] & 0x3f) | 0x80 // variant rfc 4122
+	return u.String()
+}
+
+// recreatePointTxs recreates an empty point_txs with the id column of s and empties user_points.
+// The table is rebuilt by replaying the migrations, so it matches a migrated db;
+// serial ids then change the uuid id to an identity column, the table is empty so no id is lost.
+func recreatePointTxs(db *sql.DB, s txIDStrategy) {
+	ctx := pgctx.NewContext(context.Background(), db)
+	_, err := pgctx.Exec(ctx, tableSQL(`
+		drop table if exists {point_txs};
+		truncate table {user_points};
+		delete from {schema_migrations};
+	`))
+	if err != nil {
+		log.Fatalf("can not drop point_txs: %v", err)
+	}
+	err = migrate(ctx)
+	if err != nil {
+		log.Fatalf("can not recreate point_txs: %v", err)
+	}
+
+	if s == txIDSerial {
+		_, err = pgctx.Exec(ctx, tableSQL(`
+			alter table {point_txs} alter column id type bigint using null::bigint;
+			alter table {point_txs} alter column id add generated by default as identity;
+		`))
+		if err != nil {
+			log.Fatalf("can not change point_txs ids to %s: %v", s, err)
+		}
+	}
+}
+
+// runTxIDBench runs the batch load test once for each tx id strategy,
+// point_txs is recreated with the uuid schema afterward unless a load test left its workers running.
+func runTxIDBench(ctx context.Context, shardDBs []*sql.DB) (err error) {
+	defer func() {
+		if err != nil {
+			return
+		}
+		currentTxIDStrategy.Store(int32(txIDUUID))
+		for _, sdb := range shardDBs {
+			recreatePointTxs(sdb, txIDUUID)
+		}
+	}()
+
+	results := make([]uint64, len(txIDStrategies))
+	for i, s := range txIDStrategies {
+		for _, sdb := range shardDBs {
+			recreatePointTxs(sdb, s)
+		}
+		currentTxIDStrategy.Store(int32(s))
+
+		results[i], err = runLoadTest(ctx, fmt.Sprintf("batch (tx id: %s)", s), addPointBatch)
+		if err != nil {
+			return err
+		}
+		time.Sleep(time.Second)
+
+		for _, sdb := range shardDBs {
+			printConsistency(pgctx.NewContext(ctx, sdb))
+		}
+		if interrupted.Err() != nil {
+			results = results[:i+1]
+			break
+		}
+	}
+
+	for i, r := range results {
+		fmt.Printf("tx id %s: %d op/s\n", txIDStrategies[i], r)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestTxIDStrategyNewID(t *testing.T) {
+	for _, s := range []txIDStrategy{txIDUUID, txIDTimeOrdered} {
+		id := s.newID()
+		u, err := uuid.Parse(id)
+		if err != nil {
+			t.Errorf("%s id %q: %v", s, id, err)
+			continue
+		}
+		if u.Variant() != uuid.RFC4122 {
+			t.Errorf("%s id %q has variant %s", s, id, u.Variant())
+		}
+	}
+	if id := txIDSerial.newID(); id != "" {
+		t.Errorf("bigserial id = %q, want empty for the db to generate it", id)
+	}
+}
+
+func TestTimeOrderedUUID(t *testing.T) {
+	before := time.Now().UnixMilli()
+	a := uuid.MustParse(newTimeOrderedUUID())
+	after := time.Now().UnixMilli()
+	time.Sleep(2 * time.Millisecond)
+	b := uuid.MustParse(newTimeOrderedUUID())
+
+	if a.Version() != 7 {
+		t.Errorf("version = %d, want 7", a.Version())
+	}
+	var ts [8]byte
+	copy(ts[2:], a[:6])
+	if ms := int64(binary.BigEndian.Uint64(ts[:])); ms < before || ms > after {
+		t.Errorf("timestamp of %s is %d, want between %d and %d", a, ms, before, after)
+	}
+	// ids of later millis sort after, so inserts append to the index
+	if a.String() >= b.String() {
+		t.Errorf("%s generated later sorts before %s", b, a)
+	}
+}
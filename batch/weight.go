@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"time"
+)
+
+// simulated op cost
+var (
+	simLatency  = flag.Duration("sim-latency", 0, "simulated extra db time per unit of op weight, 0 disables")
+	heavyRatio  = flag.Float64("heavy-ratio", 0, "fraction of operations that are heavy")
+	heavyWeight = flag.Int("heavy-weight", 10, "weight of a heavy operation, normal operations weigh 1")
+)
+
+type opWeightKey struct{}
+
+// withOpWeight returns a context carrying the weight of the op run with it.
+func withOpWeight(ctx context.Context, weight int) context.Context {
+	return context.WithValue(ctx, opWeightKey{}, weight)
+}
+
+func opWeight(ctx context.Context) int {
+	w, ok := ctx.Value(opWeightKey{}).(int)
+	if !ok {
+		return 1
+	}
+	return w
+}
+
+// simulateLatency holds the caller for the simulated db time of weight,
+// it returns the ctx error when ctx is done first.
+func simulateLatency(ctx context.Context, weight int) error {
+	if *simLatency <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(*simLatency * time.Duration(weight))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
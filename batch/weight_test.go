@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOpWeight(t *testing.T) {
+	ctx := context.Background()
+	if w := opWeight(ctx); w != 1 {
+		t.Errorf("default weight = %d, want 1", w)
+	}
+	if w := opWeight(withOpWeight(ctx, 10)); w != 10 {
+		t.Errorf("weight = %d, want 10", w)
+	}
+}
+
+func TestOpsWeight(t *testing.T) {
+	ops := []op{{weight: 1}, {weight: 10}, {weight: 1}}
+	if w := opsWeight(ops); w != 12 {
+		t.Errorf("opsWeight = %d, want 12", w)
+	}
+	if w := opsWeight(nil); w != 0 {
+		t.Errorf("opsWeight of no ops = %d, want 0", w)
+	}
+}
+
+func TestSimulateLatencyWeight(t *testing.T) {
+	setFlag(t, "sim-latency", "5ms")
+
+	elapsed := func(weight int) time.Duration {
+		start := time.Now()
+		err := simulateLatency(context.Background(), weight)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(start)
+	}
+
+	light, heavy := elapsed(1), elapsed(10)
+	if light < 5*time.Millisecond {
+		t.Errorf("weight 1 took %s, want at least 5ms", light)
+	}
+	if heavy < 50*time.Millisecond {
+		t.Errorf("weight 10 took %s, want at least 50ms", heavy)
+	}
+	if heavy < 5*light {
+		t.Errorf("weight 10 took %s, not proportionally more than the %s of weight 1", heavy, light)
+	}
+}
+
+func TestSimulateLatencyCanceled(t *testing.T) {
+	setFlag(t, "sim-latency", "1s")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := simulateLatency(ctx, 100)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("returned after %s, want right after ctx is done", d)
+	}
+}
+
+func TestSimulateLatencyDisabled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// disabled, so not even a done ctx fails the op
+	if err := simulateLatency(ctx, 10); err != nil {
+		t.Errorf("got error %v with -sim-latency 0", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+)
+
+var (
+	zipfUsers = flag.Int("zipf-users", 0, "pick the user of every op from this many users with a zipfian distribution, "+
+		"so a few hot users get most ops; 0 gives each worker its own user")
+	zipfS = flag.Float64("zipf-s", 1.1, "skew of the zipfian user distribution, must be > 1, larger values concentrate ops on fewer users")
+)
+
+var (
+	// zipfUserIDs are the user ids picked by -zipf-users, user 0 is the hottest
+	zipfUserIDs []string
+
+	// zipfOpCnt is the successful ops of each zipf user in the current load test
+	zipfOpCnt []atomic.Uint64
+)
+
+// setupZipfUsers creates the user set of -zipf-users, it must be called after flag.Parse.
+func setupZipfUsers() error {
+	if *zipfUsers <= 0 {
+		return nil
+	}
+	if *zipfS <= 1 {
+		return fmt.Errorf("-zipf-s must be > 1, got %g", *zipfS)
+	}
+	if *hotkeys > 0 {
+		return fmt.Errorf("-zipf-users and -hotkeys can not be used together")
+	}
+
+	zipfUserIDs = make([]string, *zipfUsers)
+	for i := range zipfUserIDs {
+		zipfUserIDs[i] = fmt.Sprintf("zipf-%d", i)
+	}
+	zipfOpCnt = make([]atomic.Uint64, *zipfUsers)
+	return nil
+}
+
+// newUserPicker returns a func picking the user of the next op of a load loop from rnd,
+// it keeps the loop's own user unless -zipf-users is set.
+func newUserPicker(rnd *rand.Rand) func(user int, userID string) (int, string) {
+	if zipfUserIDs == nil {
+		return func(user int, userID string) (int, string) {
+			return user, userID
+		}
+	}
+
+	z := rand.NewZipf(rnd, *zipfS, 1, uint64(len(zipfUserIDs)-1))
+	return func(int, string) (int, string) {
+		u := int(z.Uint64())
+		return u, zipfUserIDs[u]
+	}
+}
+
+// countZipfOp counts a successful op of the zipf user.
+func countZipfOp(user int) {
+	if zipfOpCnt != nil {
+		zipfOpCnt[user].Add(1)
+	}
+}
+
+func resetZipfOpCnt() {
+	for i := range zipfOpCnt {
+		zipfOpCnt[i].Store(0)
+	}
+}
+
+// maxZipfOpCnt returns the zipf user with the most successful ops and its count.
+func maxZipfOpCnt() (userID string, cnt uint64) {
+	for i := range zipfOpCnt {
+		if c := zipfOpCnt[i].Load(); c > cnt || userID == "" {
+			userID, cnt = zipfUserIDs[i], c
+		}
+	}
+	return userID, cnt
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// setZipfUsers sets up n zipf users for the test.
+func setZipfUsers(t *testing.T, n int) {
+	t.Helper()
+	setFlag(t, "zipf-users", "0")
+	*zipfUsers = n
+	t.Cleanup(func() {
+		zipfUserIDs = nil
+		zipfOpCnt = nil
+	})
+	err := setupZipfUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetupZipfUsers(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		setZipfUsers(t, 0)
+		if zipfUserIDs != nil {
+			t.Errorf("zipf users set up without -zipf-users")
+		}
+	})
+
+	t.Run("users", func(t *testing.T) {
+		setZipfUsers(t, 3)
+		if len(zipfUserIDs) != 3 || zipfUserIDs[0] != "zipf-0" || zipfUserIDs[2] != "zipf-2" {
+			t.Errorf("zipfUserIDs = %v", zipfUserIDs)
+		}
+		if len(zipfOpCnt) != 3 {
+			t.Errorf("got %d op counters, want 3", len(zipfOpCnt))
+		}
+	})
+
+	t.Run("skew", func(t *testing.T) {
+		setFlag(t, "zipf-s", "1")
+		setFlag(t, "zipf-users", "3")
+		if err := setupZipfUsers(); err == nil {
+			t.Error("accepted -zipf-s 1")
+		}
+	})
+
+	t.Run("hotkeys", func(t *testing.T) {
+		setFlag(t, "hotkeys", "2")
+		setFlag(t, "zipf-users", "3")
+		if err := setupZipfUsers(); err == nil {
+			t.Error("accepted -zipf-users with -hotkeys")
+		}
+	})
+}
+
+func TestNewUserPickerKeepsUserWithoutZipf(t *testing.T) {
+	pick := newUserPicker(rand.New(rand.NewSource(1)))
+	for i := 0; i < 10; i++ {
+		if user, userID := pick(7, "user-7"); user != 7 || userID != "user-7" {
+			t.Fatalf("pick = %d %s, want the loop's user", user, userID)
+		}
+	}
+}
+
+func TestNewUserPickerZipf(t *testing.T) {
+	setZipfUsers(t, 100)
+
+	picks := func(seed int64) []int {
+		pick := newUserPicker(rand.New(rand.NewSource(seed)))
+		users := make([]int, 10000)
+		for i := range users {
+			var userID string
+			users[i], userID = pick(0, "")
+			if userID != zipfUserIDs[users[i]] {
+				t.Fatalf("user %d has id %s", users[i], userID)
+			}
+		}
+		return users
+	}
+
+	// the same seed picks the same users, so -seed reproduces a run
+	a, b := picks(42), picks(42)
+	cnt := make([]int, 100)
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("pick %d differs for the same seed: %d and %d", i, a[i], b[i])
+		}
+		cnt[a[i]]++
+	}
+
+	// user 0 is the hottest and the hottest tenth of the users takes most picks
+	for u := 1; u < len(cnt); u++ {
+		if cnt[u] > cnt[0] {
+			t.Errorf("user %d picked %d times, more than user 0 with %d", u, cnt[u], cnt[0])
+		}
+	}
+	head := 0
+	for _, c := range cnt[:10] {
+		head += c
+	}
+	if head < len(a)/2 {
+		t.Errorf("the 10 hottest users got %d of %d picks, want most", head, len(a))
+	}
+}
+
+func TestZipfOpCnt(t *testing.T) {
+	setZipfUsers(t, 3)
+
+	countZipfOp(1)
+	countZipfOp(2)
+	countZipfOp(1)
+	if userID, cnt := maxZipfOpCnt(); userID != "zipf-1" || cnt != 2 {
+		t.Errorf("maxZipfOpCnt = %s %d, want zipf-1 2", userID, cnt)
+	}
+
+	resetZipfOpCnt()
+	if userID, cnt := maxZipfOpCnt(); userID != "zipf-0" || cnt != 0 {
+		t.Errorf("maxZipfOpCnt after reset = %s %d, want zipf-0 0", userID, cnt)
+	}
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("DB_URL", "")
+	t.Setenv("BATCH_FLUSH_INTERVAL", "")
+	t.Setenv("BATCH_QUEUE_SIZE", "")
+	t.Setenv("FEATURE_CACHE_REFRESH_INTERVAL", "")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.QueueSize != 20000 || cfg.FlushInterval != 100*time.Millisecond || cfg.FeatureCacheRefresh != 2*time.Second {
+		t.Errorf("defaults = %+v", cfg)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		key, value string
+	}{
+		{"BATCH_QUEUE_SIZE", "0"},
+		{"BATCH_QUEUE_SIZE", "-1"},
+		{"BATCH_QUEUE_SIZE", "many"},
+		{"BATCH_FLUSH_INTERVAL", "-1s"},
+		{"BATCH_FLUSH_INTERVAL", "100"},
+		{"FEATURE_CACHE_REFRESH_INTERVAL", "0s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key+"="+tt.value, func(t *testing.T) {
+			t.Setenv(tt.key, tt.value)
+			if _, err := LoadConfig(); err == nil {
+				t.Errorf("%s=%s accepted", tt.key, tt.value)
+			}
+		})
+	}
+
+	t.Setenv("BATCH_QUEUE_SIZE", "1")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.QueueSize != 1 {
+		t.Errorf("QueueSize = %d, want 1", cfg.QueueSize)
+	}
+}
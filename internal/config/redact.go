@@ -0,0 +1,35 @@
+package config
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// invalidDBURL replaces a db url that can not be parsed, it may hold a password in any part.
+const invalidDBURL = "<invalid db url>"
+
+// dsnPassword matches the password of a keyword/value connection string, e.g. host=localhost password=secret
+var dsnPassword = regexp.MustCompile(`(?i)\b(password|sslpassword)\s*=\s*('(?:[^'\\]|\\.)*'|\S+)`)
+
+// RedactDBURL returns dbURL with its passwords masked, safe to log.
+// It masks the userinfo password and the password query params of a url,
+// and the password keys of a keyword/value connection string.
+func RedactDBURL(dbURL string) string {
+	if !strings.Contains(dbURL, "://") {
+		return dsnPassword.ReplaceAllString(dbURL, "$1=xxxxx")
+	}
+
+	u, err := url.Parse(dbURL)
+	if err != nil {
+		return invalidDBURL
+	}
+	q := u.Query()
+	for k := range q {
+		if strings.EqualFold(k, "password") || strings.EqualFold(k, "sslpassword") {
+			q.Set(k, "xxxxx")
+			u.RawQuery = q.Encode()
+		}
+	}
+	return u.Redacted()
+}
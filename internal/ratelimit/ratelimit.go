@@ -0,0 +1,127 @@
+// Package ratelimit is the per key token bucket limiter shared by the batch and singleflight demos,
+// batch limits the ops of a user and singleflight the requests of a client ip.
+package ratelimit
+
+import (
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// shardCount splits the buckets so keys on different shards never contend on a lock
+const shardCount = 64
+
+// pruneMin is the fewest new buckets between prunes of a shard
+const pruneMin = 1024
+
+// Limiter is a per key token bucket limiter,
+// each shard holds at most maxKeys/shardCount buckets when maxKeys is set.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	maxPerShard int
+	shards      [shardCount]shard
+}
+
+type shard struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+
+	// added is the number of buckets created since the last prune,
+	// the next prune runs once it reaches pruneAfter
+	added      int
+	pruneAfter int
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New returns a limiter allowing rate per second per key with bursts of burst,
+// it tracks at most about maxKeys keys, 0 does not bound them.
+func New(rate float64, burst int, maxKeys int) *Limiter {
+	l := &Limiter{
+		rate:  rate,
+		burst: float64(max(burst, 1)),
+	}
+	if maxKeys > 0 {
+		l.maxPerShard = max(maxKeys/shardCount, 1)
+	}
+	for i := range l.shards {
+		l.shards[i].buckets = make(map[string]*tokenBucket)
+		l.shards[i].pruneAfter = pruneMin
+	}
+	return l
+}
+
+// Allow takes a token from the bucket of key at now, false when the bucket is empty.
+func (l *Limiter) Allow(key string, now time.Time) bool {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	s := &l.shards[h.Sum32()%shardCount]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.buckets[key]
+	if b == nil {
+		if s.added >= s.pruneAfter {
+			l.prune(s, now)
+		}
+		if l.maxPerShard > 0 && len(s.buckets) >= l.maxPerShard {
+			// an arbitrary bucket goes to keep the shard bounded, without a scan per new key
+			for k := range s.buckets {
+				delete(s.buckets, k)
+				break
+			}
+		}
+		s.added++
+		b = &tokenBucket{tokens: l.burst, last: now}
+		s.buckets[key] = b
+	}
+
+	l.refill(b, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *Limiter) refill(b *tokenBucket, now time.Time) {
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+}
+
+// prune drops the refilled buckets of s, a full bucket is the same as a missing one.
+// The next prune waits until as many buckets as are left were created,
+// so pruning stays amortized constant per new key.
+func (l *Limiter) prune(s *shard, now time.Time) {
+	for k, b := range s.buckets {
+		l.refill(b, now)
+		if b.tokens >= l.burst {
+			delete(s.buckets, k)
+		}
+	}
+	s.added = 0
+	s.pruneAfter = max(len(s.buckets), pruneMin)
+}
+
+// Middleware limits the requests to h per client ip, a limited request gets 429.
+func (l *Limiter) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		if !l.Allow(client, time.Now()) {
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiterPerKey(t *testing.T) {
+	l := New(1, 3, 0)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !l.Allow("hot", now) {
+			t.Fatalf("op %d of the burst rejected", i)
+		}
+	}
+	if l.Allow("hot", now) {
+		t.Fatal("op over the burst allowed")
+	}
+
+	// the other keys have their own buckets
+	for i := 0; i < 10; i++ {
+		if !l.Allow(fmt.Sprintf("user-%d", i), now) {
+			t.Errorf("user-%d rejected while hot is limited", i)
+		}
+	}
+
+	now = now.Add(time.Second)
+	if !l.Allow("hot", now) {
+		t.Error("refilled token rejected")
+	}
+	if l.Allow("hot", now) {
+		t.Error("op over the refill rate allowed")
+	}
+}
+
+func TestLimiterRefill(t *testing.T) {
+	l := New(10, 1, 1000)
+	now := time.Now()
+
+	if !l.Allow("a", now) {
+		t.Fatal("first request limited")
+	}
+	if l.Allow("a", now.Add(50*time.Millisecond)) {
+		t.Error("allowed before a token is refilled")
+	}
+	if !l.Allow("a", now.Add(150*time.Millisecond)) {
+		t.Error("limited after a token is refilled")
+	}
+}
+
+func TestLimiterBounded(t *testing.T) {
+	l := New(1, 1, shardCount)
+	now := time.Now()
+
+	for i := 0; i < 10000; i++ {
+		l.Allow(fmt.Sprintf("client-%d", i), now)
+	}
+	for i := range l.shards {
+		if n := len(l.shards[i].buckets); n > l.maxPerShard {
+			t.Errorf("shard %d holds %d buckets, max %d", i, n, l.maxPerShard)
+		}
+	}
+}
+
+func TestLimiterPrunesRefilledBuckets(t *testing.T) {
+	l := New(1, 1, 0)
+	now := time.Now()
+
+	for i := 0; i < 4*shardCount*pruneMin; i++ {
+		l.Allow(fmt.Sprintf("client-%d", i), now)
+		// every bucket is refilled a second later, so each prune empties its shard
+		now = now.Add(time.Second)
+	}
+	for i := range l.shards {
+		if n := len(l.shards[i].buckets); n > 2*pruneMin {
+			t.Errorf("shard %d holds %d buckets after pruning", i, n)
+		}
+	}
+}
+
+func TestLimiterMiddleware(t *testing.T) {
+	l := New(1, 2, 1000)
+	h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	get := func(remoteAddr string) int {
+		r := httptest.NewRequest(http.MethodGet, "/f1", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// the burst passes, then the client is limited
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if code := get("10.0.0.1:1234"); code != want {
+			t.Errorf("request %d of client 1: got %d, want %d", i, code, want)
+		}
+	}
+	// the port is not part of the client
+	if code := get("10.0.0.1:5678"); code != http.StatusTooManyRequests {
+		t.Errorf("client 1 from another port: got %d, want %d", code, http.StatusTooManyRequests)
+	}
+	// another client has its own bucket
+	if code := get("10.0.0.2:1234"); code != http.StatusOK {
+		t.Errorf("client 2: got %d, want %d", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	benchEndpoint    = flag.String("bench", "", "endpoint to load test in process, e.g. /f2; the server exits after printing the result")
+	benchConcurrency = flag.Int("bench-concurrency", 100, "number of concurrent requests of -bench")
+	benchDuration    = flag.Duration("bench-duration", 5*time.Second, "duration of -bench")
+)
+
+// featureQueries counts the feature reads sent to the db, including the cache refreshes,
+// the db load an endpoint saves by deduping or caching.
+// It is served at /debug/queries, a POST resets it.
+var featureQueries atomic.Uint64
+
+// serveQueries serves the feature query count, POST returns the count and resets it.
+func serveQueries(w http.ResponseWriter, r *http.Request) {
+	var cnt uint64
+	switch r.Method {
+	case http.MethodGet:
+		cnt = featureQueries.Load()
+	case http.MethodPost:
+		cnt = featureQueries.Swap(0)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintf(w, "%d\n", cnt)
+}
+
+// runHTTPBench sends GET url from -bench-concurrency goroutines for -bench-duration and prints the result.
+func runHTTPBench(ctx context.Context, url string) {
+	fmt.Printf("Running %s load test...\n", url)
+
+	ctx, cancel := context.WithTimeout(ctx, *benchDuration)
+	defer cancel()
+
+	client := &http.Client{
+		// keep a connection per worker instead of dialing a new one for every request
+		Transport: &http.Transport{MaxIdleConnsPerHost: *benchConcurrency},
+	}
+
+	var (
+		wg       sync.WaitGroup
+		okCnt    atomic.Uint64
+		errCnt   atomic.Uint64
+		queries0 = featureQueries.Load()
+		start    = time.Now()
+	)
+	for i := 0; i < *benchConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				err := benchGet(ctx, client, url)
+				// a request cut by the end of the benchmark is not counted
+				if ctx.Err() != nil {
+					return
+				}
+				if err != nil {
+					errCnt.Add(1)
+					continue
+				}
+				okCnt.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	diff := time.Since(start)
+	cnt := okCnt.Load()
+	errs := errCnt.Load()
+	fmt.Printf("duration: %s\n", diff)
+	fmt.Printf("requests: %d\n", cnt)
+	fmt.Printf("errors: %d\n", errs)
+	fmt.Printf("db queries: %d\n", featureQueries.Load()-queries0)
+	fmt.Printf("req/s: %d\n", uint64(float64(cnt+errs)/diff.Seconds()))
+}
+
+func benchGet(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// drain so the connection is reused
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// SingleFlightCache dedupes concurrent loads for the same key
+// and caches the loaded value for TTL.
+// Zero TTL only dedupes, the value is never cached.
+// Errors are never cached, a failed load is dropped once it returns
+// so the next Get after an error loads again.
+//
+// The load runs on the ctx of the Get that started it without its cancel,
+// a waiter whose ctx is done returns its ctx error and leaves the load to the others.
+type SingleFlightCache[K comparable, V any] struct {
+	TTL time.Duration
+
+	mu    sync.RWMutex
+	m     map[K]singleFlightCacheEntry[V]
+	calls map[K]*singleFlightCall[V]
+
+	// sweptAt is when expired entries were last deleted from m,
+	// a key that is never loaded again would otherwise stay forever
+	sweptAt time.Time
+}
+
+type singleFlightCacheEntry[V any] struct {
+	value     V
+	expiresAt time.Time
+}
+
+// singleFlightCall is an in-flight load, done is closed once value and err are set.
+type singleFlightCall[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+func (c *SingleFlightCache[K, V]) Get(ctx context.Context, key K, loader func(ctx context.Context) (V, error)) (V, error) {
+	if c.TTL > 0 {
+		c.mu.RLock()
+		e, ok := c.m[key]
+		c.mu.RUnlock()
+		if ok && time.Now().Before(e.expiresAt) {
+			return e.value, nil
+		}
+	}
+
+	c.mu.Lock()
+	call, ok := c.calls[key]
+	if !ok {
+		if c.calls == nil {
+			c.calls = make(map[K]*singleFlightCall[V])
+		}
+		call = &singleFlightCall[V]{done: make(chan struct{})}
+		c.calls[key] = call
+		go c.load(context.WithoutCancel(ctx), key, call, loader)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		var zero V
+		return zero, ctx.Err()
+	}
+}
+
+func (c *SingleFlightCache[K, V]) load(ctx context.Context, key K, call *singleFlightCall[V], loader func(ctx context.Context) (V, error)) {
+	v, err := loader(ctx)
+	if err != nil {
+		var zero V
+		v = zero
+	}
+	call.value, call.err = v, err
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	if err == nil && c.TTL > 0 {
+		if c.m == nil {
+			c.m = make(map[K]singleFlightCacheEntry[V])
+		}
+		now := time.Now()
+		c.sweep(now)
+		c.m[key] = singleFlightCacheEntry[V]{
+			value:     v,
+			expiresAt: now.Add(c.TTL),
+		}
+	}
+	c.mu.Unlock()
+	close(call.done)
+}
+
+// sweep deletes the expired entries at most once per TTL, so m holds at most the keys loaded in the last two TTLs.
+// c.mu must be held.
+func (c *SingleFlightCache[K, V]) sweep(now time.Time) {
+	if now.Sub(c.sweptAt) < c.TTL {
+		return
+	}
+	for key, e := range c.m {
+		if !now.Before(e.expiresAt) {
+			delete(c.m, key)
+		}
+	}
+	c.sweptAt = now
+}
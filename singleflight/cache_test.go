@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSingleFlightCacheDedupesConcurrentGets(t *testing.T) {
+	c := &SingleFlightCache[string, int]{TTL: time.Minute}
+
+	var loads atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	loader := func(ctx context.Context) (int, error) {
+		if loads.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return 42, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]int, 50)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, err := c.Get(context.Background(), "f", loader)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = v
+		}(i)
+	}
+
+	// a Get that misses the in-flight load finds the cached value instead
+	<-started
+	close(release)
+	wg.Wait()
+
+	if n := loads.Load(); n != 1 {
+		t.Errorf("loader called %d times, want 1", n)
+	}
+	for i, v := range results {
+		if v != 42 {
+			t.Errorf("get %d = %d, want 42", i, v)
+		}
+	}
+}
+
+func TestSingleFlightCacheKeys(t *testing.T) {
+	c := &SingleFlightCache[string, string]{TTL: time.Minute}
+
+	var loads atomic.Int32
+	for _, key := range []string{"a", "b", "a", "b"} {
+		v, err := c.Get(context.Background(), key, func(ctx context.Context) (string, error) {
+			loads.Add(1)
+			return key, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != key {
+			t.Errorf("get %s = %s", key, v)
+		}
+	}
+	if n := loads.Load(); n != 2 {
+		t.Errorf("loader called %d times, want once per key", n)
+	}
+}
+
+func TestSingleFlightCacheTTL(t *testing.T) {
+	c := &SingleFlightCache[string, int]{TTL: 10 * time.Millisecond}
+
+	var loads atomic.Int32
+	loader := func(ctx context.Context) (int, error) {
+		return int(loads.Add(1)), nil
+	}
+
+	get := func() int {
+		v, err := c.Get(context.Background(), "f", loader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	if v := get(); v != 1 {
+		t.Fatalf("first get = %d, want 1", v)
+	}
+	if v := get(); v != 1 {
+		t.Errorf("cached get = %d, want 1", v)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if v := get(); v != 2 {
+		t.Errorf("get after TTL = %d, want a new load", v)
+	}
+}
+
+func TestSingleFlightCacheDoesNotCacheErrors(t *testing.T) {
+	c := &SingleFlightCache[string, int]{TTL: time.Minute}
+	errLoad := errors.New("load failed")
+
+	_, err := c.Get(context.Background(), "f", func(ctx context.Context) (int, error) {
+		return 0, errLoad
+	})
+	if !errors.Is(err, errLoad) {
+		t.Fatalf("got error %v, want %v", err, errLoad)
+	}
+
+	v, err := c.Get(context.Background(), "f", func(ctx context.Context) (int, error) {
+		return 7, nil
+	})
+	if err != nil || v != 7 {
+		t.Errorf("get after error = %d %v, want a new load", v, err)
+	}
+}
+
+// keys are compared by value and type, 1 and "1" are loaded apart
+func TestSingleFlightCacheTypedKeys(t *testing.T) {
+	c := &SingleFlightCache[any, string]{TTL: time.Minute}
+
+	for _, key := range []any{1, "1"} {
+		v, err := c.Get(context.Background(), key, func(ctx context.Context) (string, error) {
+			return fmt.Sprintf("%T", key), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("%T", key); v != want {
+			t.Errorf("get %#v = %s, want %s", key, v, want)
+		}
+	}
+}
+
+// a canceled waiter returns its own error, the load and the other waiters go on
+func TestSingleFlightCacheCanceledWaiter(t *testing.T) {
+	c := &SingleFlightCache[string, int]{}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var startOnce sync.Once
+	var loaderErr atomic.Value
+	loader := func(ctx context.Context) (int, error) {
+		startOnce.Do(func() { close(started) })
+		<-release
+		if err := ctx.Err(); err != nil {
+			loaderErr.Store(err)
+		}
+		return 42, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := c.Get(ctx, "f", loader)
+		first <- err
+	}()
+	<-started
+
+	second := make(chan int, 1)
+	go func() {
+		v, err := c.Get(context.Background(), "f", loader)
+		if err != nil {
+			t.Error(err)
+		}
+		second <- v
+	}()
+
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled get = %v, want %v", err, context.Canceled)
+	}
+	close(release)
+	if v := <-second; v != 42 {
+		t.Errorf("other get = %d, want 42", v)
+	}
+	if err := loaderErr.Load(); err != nil {
+		t.Errorf("loader ctx done with %v", err)
+	}
+}
+
+// an expired key that is not loaded again is deleted by a later load of another key
+func TestSingleFlightCacheSweep(t *testing.T) {
+	c := &SingleFlightCache[string, int]{TTL: 10 * time.Millisecond}
+	loader := func(ctx context.Context) (int, error) { return 1, nil }
+
+	for _, key := range []string{"a", "b"} {
+		if _, err := c.Get(context.Background(), key, loader); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, err := c.Get(context.Background(), "c", loader); err != nil {
+		t.Fatal(err)
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if _, ok := c.m["a"]; ok || len(c.m) != 1 {
+		t.Errorf("cached %d keys after the TTL, want only c", len(c.m))
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/lib/pq"
+)
+
+var driverName = flag.String("driver", "postgres", "database/sql driver, postgres (lib/pq) or pgx (pgx/stdlib)")
+
+// sqlDriver is the driver specific part of the queries.
+type sqlDriver interface {
+	// array wraps a slice bound as a single array parameter
+	array(v any) any
+
+	// scanArray wraps a pointer to a slice scanned from an array column
+	scanArray(v any) any
+}
+
+// dbDriver is set from -driver by setupDriver
+var dbDriver sqlDriver = pqDriver{}
+
+// setupDriver selects the driver, it must be called after flag.Parse.
+func setupDriver() error {
+	switch *driverName {
+	case "postgres":
+		dbDriver = pqDriver{}
+	case "pgx":
+		dbDriver = pgxDriver{}
+	default:
+		return fmt.Errorf("unknown driver %q", *driverName)
+	}
+	return nil
+}
+
+type pqDriver struct{}
+
+func (pqDriver) array(v any) any {
+	return pq.Array(v)
+}
+
+func (pqDriver) scanArray(v any) any {
+	return pq.Array(v)
+}
+
+type pgxDriver struct{}
+
+// array returns v as is, pgx encodes slices as arrays.
+func (pgxDriver) array(v any) any {
+	return v
+}
+
+// scanArray scans through a pgtype map, pgx/stdlib returns arrays as text.
+// A map caches scan plans and is not safe for concurrent use, so each scan gets its own.
+func (pgxDriver) scanArray(v any) any {
+	return pgtype.NewMap().SQLScanner(v)
+}
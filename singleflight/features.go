@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// featureResult is the evaluation of a feature served by /features.
+type featureResult struct {
+	Active  bool   `json:"active"`
+	Variant string `json:"variant,omitempty"`
+}
+
+// serveFeatures serves GET /features?name=&name=&user_id=&source= as a json object of feature name to its evaluation.
+// Without user_id the features are evaluated for every user, with it the rollout and variant of the user are applied.
+// The features are read from the feature cache, or with source=db from the db on every request like /f1.
+func serveFeatures(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	names := r.URL.Query()["name"]
+	if len(names) == 0 || len(names) > 100 {
+		http.Error(w, "invalid name", http.StatusBadRequest)
+		return
+	}
+	userID := r.URL.Query().Get("user_id")
+
+	evaluate := cachedFeatureResults
+	switch r.URL.Query().Get("source") {
+	case "", "cache":
+	case "db":
+		evaluate = dbFeatureResults
+	default:
+		http.Error(w, "invalid source", http.StatusBadRequest)
+		return
+	}
+
+	res, err := evaluate(r.Context(), names, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// cachedFeatureResults evaluates names from the feature cache,
+// without userID from a single cache read. An unknown feature fails with errFeatureUnknown.
+func cachedFeatureResults(ctx context.Context, names []string, userID string) (map[string]featureResult, error) {
+	res := make(map[string]featureResult, len(names))
+	if userID == "" {
+		active, err := featuresActive(ctx, names...)
+		if err != nil {
+			return nil, err
+		}
+		for name, a := range active {
+			res[name] = featureResult{Active: a}
+		}
+		return res, nil
+	}
+
+	for _, name := range names {
+		err := ensureFeatureActiveForUserWithCache(ctx, name, userID)
+		if errors.Is(err, featureInactive) {
+			res[name] = featureResult{}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		variant, err := featureVariantWithCache(ctx, name, userID)
+		if err != nil {
+			return nil, err
+		}
+		res[name] = featureResult{Active: true, Variant: variant}
+	}
+	return res, nil
+}
+
+// dbFeatureResults evaluates names from the db, without userID in a single query.
+// An unknown feature is inactive.
+func dbFeatureResults(ctx context.Context, names []string, userID string) (map[string]featureResult, error) {
+	res := make(map[string]featureResult, len(names))
+	if userID == "" {
+		active, err := loadFeaturesActive(ctx, names...)
+		if err != nil {
+			return nil, err
+		}
+		for name, a := range active {
+			res[name] = featureResult{Active: a}
+		}
+		return res, nil
+	}
+
+	for _, name := range names {
+		active, err := isFeatureActiveForUser(ctx, name, userID)
+		if err != nil {
+			return nil, err
+		}
+		if !active {
+			res[name] = featureResult{}
+			continue
+		}
+
+		variant, err := featureVariant(ctx, name, userID)
+		if err != nil {
+			return nil, err
+		}
+		res[name] = featureResult{Active: true, Variant: variant}
+	}
+	return res, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func getFeatures(t *testing.T, query string) (int, map[string]featureResult) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	serveFeatures(w, httptest.NewRequest(http.MethodGet, "/features?"+query, nil))
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+	var res map[string]featureResult
+	err := json.Unmarshal(w.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, res
+}
+
+func TestServeFeatures(t *testing.T) {
+	setFeatureCache(t, map[string]featureState{
+		"new-checkout": {active: true, rollout: 30, variants: []featureVariantWeight{{"a", 50}, {"b", 50}}},
+		"off":          {active: false, rollout: 100},
+	})
+
+	tests := []struct {
+		name  string
+		query string
+		want  map[string]featureResult
+	}{
+		{"every user", "name=new-checkout&name=off", map[string]featureResult{
+			"new-checkout": {Active: true},
+			"off":          {},
+		}},
+		// user-5 is in bucket 25 of new-checkout and gets variant a, user-1 is in bucket 49
+		{"user in rollout", "name=new-checkout&name=off&user_id=user-5", map[string]featureResult{
+			"new-checkout": {Active: true, Variant: "a"},
+			"off":          {},
+		}},
+		{"user outside rollout", "name=new-checkout&user_id=user-1", map[string]featureResult{
+			"new-checkout": {},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, got := getFeatures(t, tt.query)
+			if code != http.StatusOK {
+				t.Fatalf("status %d", code)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for name, want := range tt.want {
+				if got[name] != want {
+					t.Errorf("%s = %+v, want %+v", name, got[name], want)
+				}
+			}
+		})
+	}
+
+	if code, _ := getFeatures(t, "name=missing"); code != http.StatusInternalServerError {
+		t.Errorf("unknown feature: status %d, want %d", code, http.StatusInternalServerError)
+	}
+	if code, _ := getFeatures(t, "name=off&source=disk"); code != http.StatusBadRequest {
+		t.Errorf("unknown source: status %d, want %d", code, http.StatusBadRequest)
+	}
+	if code, _ := getFeatures(t, ""); code != http.StatusBadRequest {
+		t.Errorf("no name: status %d, want %d", code, http.StatusBadRequest)
+	}
+}
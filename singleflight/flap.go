@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// flap benchmark parameter
+const (
+	// feature toggled by the flap benchmark
+	flapFeature = "flap"
+
+	// benchmark time per strategy
+	flapDuration = 10 * time.Second
+
+	// time between toggles
+	flapInterval = 500 * time.Millisecond
+
+	// number of concurrent readers
+	flapReaders = 100
+)
+
+type flapStrategy struct {
+	name     string
+	isActive func(ctx context.Context, feature string) (bool, error)
+
+	// start runs before the readers when not nil, anything it starts must stop when ctx is done
+	start func(ctx context.Context) error
+}
+
+// runFlapBench toggles a feature while readers check it through each cache strategy,
+// it reports read throughput and the delay until a toggle is observed by any reader.
+func runFlapBench(ctx context.Context) error {
+	sfCache := &SingleFlightCache[string, bool]{}
+	ttlCache := &SingleFlightCache[string, bool]{TTL: time.Second}
+
+	strategies := []flapStrategy{
+		{name: "db", isActive: isFeatureActive},
+		{name: "singleflight", isActive: func(ctx context.Context, feature string) (bool, error) {
+			return sfCache.Get(ctx, feature, func(ctx context.Context) (bool, error) {
+				return isFeatureActive(ctx, feature)
+			})
+		}},
+		{name: "ttl cache (1s)", isActive: func(ctx context.Context, feature string) (bool, error) {
+			return ttlCache.Get(ctx, feature, func(ctx context.Context) (bool, error) {
+				return isFeatureActive(ctx, feature)
+			})
+		}},
+		{name: "polling cache", isActive: isCachedFeatureActive},
+		// the same cache, also reloaded on every notified change
+		{name: "notify cache", isActive: isCachedFeatureActive, start: func(ctx context.Context) error {
+			return listenFeatureChanges(ctx, cfg.DBURL)
+		}},
+	}
+
+	for _, s := range strategies {
+		r, err := runFlapStrategy(ctx, s, flapDuration)
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.name, err)
+		}
+		r.print()
+	}
+	return nil
+}
+
+// isCachedFeatureActive reads a feature from the feature cache, an unknown feature is inactive.
+func isCachedFeatureActive(ctx context.Context, feature string) (bool, error) {
+	state, _ := getCachedFeature(feature)
+	return state.active, nil
+}
+
+// flapResult is the outcome of a strategy under the flap benchmark.
+type flapResult struct {
+	strategy string
+	reads    uint64
+	elapsed  time.Duration
+	toggles  int
+
+	// delays are the sorted propagation delays of the observed toggles
+	delays []time.Duration
+}
+
+func (r flapResult) print() {
+	fmt.Printf("strategy: %s\n", r.strategy)
+	fmt.Printf("reads/s: %d\n", uint64(float64(r.reads)/r.elapsed.Seconds()))
+	fmt.Printf("toggles: %d, observed: %d\n", r.toggles, len(r.delays))
+	fmt.Printf("propagation p50: %s, p90: %s, p99: %s\n", percentile(r.delays, 50), percentile(r.delays, 90), percentile(r.delays, 99))
+}
+
+// runFlapStrategy toggles the flap feature every flapInterval for d while readers check it through s.
+func runFlapStrategy(ctx context.Context, s flapStrategy, d time.Duration) (flapResult, error) {
+	active := true
+	err := setFeatureActive(ctx, flapFeature, active)
+	if err != nil {
+		return flapResult{}, err
+	}
+
+	var (
+		mu        sync.Mutex
+		expected  = active
+		toggledAt = time.Now()
+		observed  = true
+		delays    []time.Duration
+		toggles   int
+		readCnt   uint64
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	if s.start != nil {
+		err := s.start(ctx)
+		if err != nil {
+			return flapResult{}, err
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < flapReaders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				got, err := s.isActive(ctx, flapFeature)
+				if err != nil {
+					continue
+				}
+				atomic.AddUint64(&readCnt, 1)
+
+				mu.Lock()
+				if !observed && got == expected {
+					observed = true
+					delays = append(delays, time.Since(toggledAt))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	start := time.Now()
+	ticker := time.NewTicker(flapInterval)
+	defer ticker.Stop()
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-ticker.C:
+		}
+
+		active = !active
+		err := setFeatureActive(ctx, flapFeature, active)
+		if err != nil {
+			continue
+		}
+
+		mu.Lock()
+		expected = active
+		toggledAt = time.Now()
+		observed = false
+		toggles++
+		mu.Unlock()
+	}
+	wg.Wait()
+
+	sort.Slice(delays, func(i, j int) bool { return delays[i] < delays[j] })
+	return flapResult{
+		strategy: s.name,
+		reads:    readCnt,
+		elapsed:  time.Since(start),
+		toggles:  toggles,
+		delays:   delays,
+	}, nil
+}
+
+// percentile returns the p-th percentile of sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := len(sorted) * p / 100
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
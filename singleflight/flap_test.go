@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	sorted := make([]time.Duration, 10)
+	for i := range sorted {
+		sorted[i] = time.Duration(i+1) * time.Millisecond
+	}
+
+	tests := []struct {
+		sorted []time.Duration
+		p      int
+		want   time.Duration
+	}{
+		{nil, 50, 0},
+		{sorted, 0, time.Millisecond},
+		{sorted, 50, 6 * time.Millisecond},
+		{sorted, 90, 10 * time.Millisecond},
+		{sorted, 99, 10 * time.Millisecond},
+		{sorted, 100, 10 * time.Millisecond},
+		{sorted[:1], 99, time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := percentile(tt.sorted, tt.p); got != tt.want {
+			t.Errorf("percentile of %d durations at p%d = %s, want %s", len(tt.sorted), tt.p, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	setupTables()
+	os.Exit(m.Run())
+}
+
+// the hashes are golden, a change moves users between rollout buckets and variants
+func TestFeatureHash(t *testing.T) {
+	tests := []struct {
+		parts []string
+		want  uint32
+	}{
+		{nil, 2166136261},
+		{[]string{""}, 2166136261},
+		{[]string{"a"}, 3826002220},
+		{[]string{"f1", "u1"}, 783745698},
+		// the separator keeps the parts apart
+		{[]string{"f1u", "1"}, 654582124},
+		{[]string{"new-checkout", "user-42"}, 1698685336},
+		{[]string{"new-checkout", "user-42", "variant"}, 3484020393},
+	}
+	for _, tt := range tests {
+		if got := featureHash(tt.parts...); got != tt.want {
+			t.Errorf("featureHash(%q) = %d, want %d", tt.parts, got, tt.want)
+		}
+	}
+}
+
+func TestFeatureStateActiveFor(t *testing.T) {
+	// user-1 is in bucket 49 of new-checkout, user-4 in bucket 6
+	tests := []struct {
+		name   string
+		state  featureState
+		userID string
+		want   bool
+	}{
+		{"inactive", featureState{active: false, rollout: 100}, "user-1", false},
+		{"no rollout", featureState{active: true, rollout: 0}, "user-4", false},
+		{"full rollout", featureState{active: true, rollout: 100}, "user-1", true},
+		{"bucket at rollout", featureState{active: true, rollout: 49}, "user-1", false},
+		{"bucket below rollout", featureState{active: true, rollout: 50}, "user-1", true},
+		{"low bucket", featureState{active: true, rollout: 7}, "user-4", true},
+		{"low bucket at rollout", featureState{active: true, rollout: 6}, "user-4", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.state.activeFor("new-checkout", tt.userID); got != tt.want {
+				t.Errorf("activeFor(new-checkout, %s) = %v, want %v", tt.userID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFeatureStateVariantFor(t *testing.T) {
+	ab := []featureVariantWeight{{"a", 50}, {"b", 50}}
+
+	// the variant hash of new-checkout is 93 mod 100 for user-42 and 0 for user-5
+	tests := []struct {
+		name   string
+		state  featureState
+		userID string
+		want   string
+	}{
+		{"inactive", featureState{active: false, rollout: 100, variants: ab}, "user-42", ""},
+		{"outside rollout", featureState{active: true, rollout: 0, variants: ab}, "user-42", ""},
+		{"no variants", featureState{active: true, rollout: 100}, "user-42", ""},
+		{"zero weights", featureState{active: true, rollout: 100, variants: []featureVariantWeight{{"a", 0}}}, "user-42", ""},
+		{"last variant", featureState{active: true, rollout: 100, variants: ab}, "user-42", "b"},
+		{"first variant", featureState{active: true, rollout: 100, variants: ab}, "user-5", "a"},
+		{"single variant", featureState{active: true, rollout: 100, variants: []featureVariantWeight{{"only", 1}}}, "user-42", "only"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.state.variantFor("new-checkout", tt.userID); got != tt.want {
+				t.Errorf("variantFor(new-checkout, %s) = %q, want %q", tt.userID, got, tt.want)
+			}
+		})
+	}
+}
+
+// setFeatureCache replaces the feature cache for the test, loaded now.
+func setFeatureCache(t *testing.T, states map[string]featureState) {
+	t.Helper()
+	featureActiveCache.Lock()
+	prev := featureActiveCache.m
+	featureActiveCache.m = make(map[string]featureCacheEntry, len(states))
+	for name, state := range states {
+		featureActiveCache.m[name] = featureCacheEntry{state: state, loadedAt: time.Now()}
+	}
+	featureActiveCache.Unlock()
+	t.Cleanup(func() {
+		featureActiveCache.Lock()
+		featureActiveCache.m = prev
+		featureActiveCache.Unlock()
+	})
+}
+
+// captureLogs sends the default logger to the returned buffer until the test ends.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &buf
+}
+
+func TestWarnNoFeatures(t *testing.T) {
+	logs := captureLogs(t)
+
+	setFeatureCache(t, nil)
+	if !warnNoFeatures() {
+		t.Error("no warning for an empty features table")
+	}
+	if !strings.Contains(logs.String(), "level=WARN") || !strings.Contains(logs.String(), "features table is empty") {
+		t.Errorf("logged %q, want the empty features warning", logs.String())
+	}
+
+	logs.Reset()
+	setFeatureCache(t, map[string]featureState{"f": {active: true, rollout: 100}})
+	if warnNoFeatures() {
+		t.Error("warned with a feature loaded")
+	}
+	if logs.Len() > 0 {
+		t.Errorf("logged %q with a feature loaded", logs.String())
+	}
+}
+
+// an unchanged feature stays fresh through the incremental refreshes that skip it
+func TestResolveCachedFeatureSyncedAt(t *testing.T) {
+	expired := time.Now().Add(-2 * (*featureCacheTTL + *featureCacheStale))
+	e := featureCacheEntry{state: featureState{active: true, rollout: 100}, loadedAt: expired}
+
+	if _, ok := resolveCachedFeature("f", e, true, time.Now()); !ok {
+		t.Error("entry older than the stale window unknown right after a refresh")
+	}
+	if _, ok := resolveCachedFeature("f", e, true, expired); ok {
+		t.Error("entry served past the stale window without a refresh")
+	}
+	e.loadedAt = time.Now()
+	if _, ok := resolveCachedFeature("f", e, true, expired); !ok {
+		t.Error("freshly loaded entry unknown after an old refresh")
+	}
+}
+
+func TestCheckJitter(t *testing.T) {
+	for _, fraction := range []float64{0, 0.2, 0.999} {
+		if err := checkJitter(fraction); err != nil {
+			t.Errorf("checkJitter(%v) = %v, want nil", fraction, err)
+		}
+	}
+	for _, fraction := range []float64{-0.1, 1, 1.5} {
+		if err := checkJitter(fraction); err == nil {
+			t.Errorf("checkJitter(%v) accepted", fraction)
+		}
+	}
+
+	// the largest accepted fraction keeps every interval positive
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		if d := jitter(time.Second, 0.999, rnd); d <= 0 {
+			t.Fatalf("jitter(1s, 0.999) = %v", d)
+		}
+	}
+}
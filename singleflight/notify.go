@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var featureCacheNotify = flag.Bool("feature-cache-notify", false, "reload a feature into the cache when the features trigger notifies its change, "+
+	"the refresh still runs and catches the changes missed while the listener reconnects")
+
+// listenFeatureChanges reloads the features notified on featuresChannel into the feature cache until ctx is done,
+// so a change reaches the cache in a round trip instead of on the next refresh.
+// The listener holds its own connection to dbURL, the reloads query the db in ctx.
+// It returns once the channel is listened to, a change committed after that is notified.
+func listenFeatureChanges(ctx context.Context, dbURL string) error {
+	l := pq.NewListener(dbURL, 100*time.Millisecond, 10*time.Second, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			slog.Error("feature change listener", "event", ev, "error", err)
+		}
+	})
+	err := l.Listen(featuresChannel())
+	if err != nil {
+		l.Close()
+		return err
+	}
+
+	go func() {
+		defer l.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case n := <-l.Notify:
+				// nil after a reconnect, the changes in between are left to the refresh
+				if n == nil {
+					continue
+				}
+				// reloaded one by one, so the last notification of a feature loads its last change
+				err := reloadCachedFeature(ctx, n.Extra)
+				if err != nil {
+					slog.Error("can not reload notified feature", "feature", n.Extra, "error", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+var errPrerequisiteCycle = errors.New("feature prerequisites form a cycle")
+
+// prerequisiteError is returned when a prerequisite of a feature, direct or transitive, is not active.
+type prerequisiteError struct {
+	Feature      string
+	Prerequisite string
+
+	// Err is featureInactive or errFeatureUnknown
+	Err error
+}
+
+func (e *prerequisiteError) Error() string {
+	return fmt.Sprintf("feature %s requires %s: %v", e.Feature, e.Prerequisite, e.Err)
+}
+
+func (e *prerequisiteError) Unwrap() error {
+	return e.Err
+}
+
+// cachedFeature returns the state of feature, checking that its prerequisites, direct or transitive,
+// are active when the feature is; lookup reads a feature from the cache.
+// Every cached evaluation goes through it, so a feature evaluates the same on every path.
+func cachedFeature(feature string, lookup func(feature string) (featureState, bool)) (featureState, error) {
+	state, ok := lookup(feature)
+	if !ok {
+		return featureState{}, errFeatureUnknown
+	}
+	// an inactive feature is inactive whatever its prerequisites
+	if !state.active {
+		return state, nil
+	}
+
+	seen := map[string]bool{feature: true}
+	pending := append([]string(nil), state.prerequisites...)
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		// cycles are dropped at load time, seen only guards against a cache mid refresh
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		s, ok := lookup(name)
+		if !ok {
+			return featureState{}, &prerequisiteError{Feature: feature, Prerequisite: name, Err: errFeatureUnknown}
+		}
+		if !s.active {
+			return featureState{}, &prerequisiteError{Feature: feature, Prerequisite: name, Err: featureInactive}
+		}
+		pending = append(pending, s.prerequisites...)
+	}
+	return state, nil
+}
+
+// findPrerequisiteCycle returns a prerequisite cycle reachable from features, or nil,
+// prerequisites returns the prerequisites of a feature.
+func findPrerequisiteCycle(features []string, prerequisites func(feature string) []string) []string {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	mark := make(map[string]int)
+	var path []string
+
+	var visit func(feature string) []string
+	visit = func(feature string) []string {
+		switch mark[feature] {
+		case done:
+			return nil
+		case visiting:
+			for i, name := range path {
+				if name == feature {
+					return append(append([]string(nil), path[i:]...), feature)
+				}
+			}
+		}
+
+		mark[feature] = visiting
+		path = append(path, feature)
+		for _, p := range prerequisites(feature) {
+			if cycle := visit(p); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		mark[feature] = done
+		return nil
+	}
+
+	for _, feature := range features {
+		if cycle := visit(feature); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// prerequisiteCycleError formats a cycle found by findPrerequisiteCycle.
+func prerequisiteCycleError(cycle []string) error {
+	return fmt.Errorf("%w: %s", errPrerequisiteCycle, strings.Join(cycle, " -> "))
+}
+
+// dropPrerequisiteCycles returns the features in a prerequisite cycle reachable from features,
+// each cycle is logged. The rest of the graph stays usable, a feature requiring a dropped one
+// evaluates with an unknown prerequisite.
+func dropPrerequisiteCycles(features []string, prerequisites func(feature string) []string) map[string]bool {
+	dropped := make(map[string]bool)
+	for {
+		cycle := findPrerequisiteCycle(features, func(feature string) []string {
+			if dropped[feature] {
+				return nil
+			}
+			return prerequisites(feature)
+		})
+		if cycle == nil {
+			return dropped
+		}
+		slog.Error("dropping features in a prerequisite cycle", "error", prerequisiteCycleError(cycle))
+		for _, feature := range cycle {
+			dropped[feature] = true
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"testing"
+)
+
+func TestCachedFeaturePrerequisites(t *testing.T) {
+	setFeatureCache(t, map[string]featureState{
+		"base":     {active: true, rollout: 100},
+		"off":      {active: false, rollout: 100},
+		"child":    {active: true, rollout: 100, prerequisites: []string{"base"}},
+		"grand":    {active: true, rollout: 100, prerequisites: []string{"child"}},
+		"blocked":  {active: true, rollout: 100, prerequisites: []string{"off"}},
+		"deep":     {active: true, rollout: 100, prerequisites: []string{"blocked"}},
+		"orphan":   {active: true, rollout: 100, prerequisites: []string{"missing"}},
+		"disabled": {active: false, rollout: 100, prerequisites: []string{"missing"}},
+	})
+
+	ctx := context.Background()
+	tests := []struct {
+		feature string
+		want    error
+	}{
+		{"child", nil},
+		{"grand", nil},
+		{"blocked", featureInactive},
+		{"deep", featureInactive},
+		{"orphan", errFeatureUnknown},
+		{"disabled", featureInactive},
+		{"nope", errFeatureUnknown},
+	}
+	for _, tt := range tests {
+		if err := ensureFeatureActiveWithCache(ctx, tt.feature); !errors.Is(err, tt.want) {
+			t.Errorf("ensureFeatureActiveWithCache(%s) = %v, want %v", tt.feature, err, tt.want)
+		}
+		if err := ensureFeatureActiveForUserWithCache(ctx, tt.feature, "user-1"); !errors.Is(err, tt.want) {
+			t.Errorf("ensureFeatureActiveForUserWithCache(%s) = %v, want %v", tt.feature, err, tt.want)
+		}
+	}
+
+	var perr *prerequisiteError
+	if err := ensureFeatureActiveWithCache(ctx, "deep"); !errors.As(err, &perr) || perr.Prerequisite != "off" {
+		t.Errorf("deep: got %v, want off as the inactive prerequisite", err)
+	}
+}
+
+// the batch and variant paths evaluate prerequisites like the single feature path
+func TestFeaturesActivePrerequisites(t *testing.T) {
+	ab := []featureVariantWeight{{"a", 50}, {"b", 50}}
+	setFeatureCache(t, map[string]featureState{
+		"base":    {active: true, rollout: 100},
+		"off":     {active: false, rollout: 100},
+		"child":   {active: true, rollout: 100, prerequisites: []string{"base"}, variants: ab},
+		"blocked": {active: true, rollout: 100, prerequisites: []string{"off"}, variants: ab},
+		"orphan":  {active: true, rollout: 100, prerequisites: []string{"missing"}},
+	})
+	ctx := context.Background()
+
+	got, err := featuresActive(ctx, "child", "blocked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]bool{"child": true, "blocked": false}; !maps.Equal(got, want) {
+		t.Errorf("featuresActive = %v, want %v", got, want)
+	}
+	if _, err := featuresActive(ctx, "child", "orphan"); !errors.Is(err, errFeatureUnknown) {
+		t.Errorf("featuresActive with an unknown prerequisite = %v, want %v", err, errFeatureUnknown)
+	}
+
+	// the prerequisites pass, the variant is the one of the feature alone
+	want := featureState{active: true, rollout: 100, variants: ab}.variantFor("child", "user-5")
+	if v, err := featureVariantWithCache(ctx, "child", "user-5"); err != nil || v != want {
+		t.Errorf("variant of child = %q, %v, want %q", v, err, want)
+	}
+	if v, err := featureVariantWithCache(ctx, "blocked", "user-5"); err != nil || v != "" {
+		t.Errorf("variant of blocked = %q, %v, want no variant", v, err)
+	}
+	if _, err := featureVariantWithCache(ctx, "orphan", "user-5"); !errors.Is(err, errFeatureUnknown) {
+		t.Errorf("variant of orphan = %v, want %v", err, errFeatureUnknown)
+	}
+}
+
+func TestDropPrerequisiteCycles(t *testing.T) {
+	logs := captureLogs(t)
+
+	prerequisites := map[string][]string{
+		"a":    {"b"},
+		"b":    {"a"},
+		"c":    {"c"},
+		"d":    {"a"},
+		"e":    {"f"},
+		"f":    nil,
+		"loop": {"x"},
+		"x":    {"y"},
+		"y":    {"x"},
+	}
+	dropped := dropPrerequisiteCycles([]string{"a", "c", "d", "e", "loop"}, func(feature string) []string {
+		return prerequisites[feature]
+	})
+
+	// d and loop only require a cycle, they are not in one
+	want := map[string]bool{"a": true, "b": true, "c": true, "x": true, "y": true}
+	if !maps.Equal(dropped, want) {
+		t.Errorf("dropped %v, want %v", dropped, want)
+	}
+	if logs.Len() == 0 {
+		t.Error("dropped cycles not logged")
+	}
+
+	if dropped := dropPrerequisiteCycles([]string{"e"}, func(feature string) []string {
+		return prerequisites[feature]
+	}); len(dropped) != 0 {
+		t.Errorf("dropped %v without a cycle", dropped)
+	}
+}
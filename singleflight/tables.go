@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+var tablePrefix = flag.String("table-prefix", "", "prefix for all table names, lets isolated demo instances share a database")
+
+// tableNames are the tables used by the demo, queries refer to them as {name}
+var tableNames = []string{"features", "feature_variants"}
+
+// triggerNames are the trigger functions and their triggers, prefixed and referred to like tables
+var triggerNames = []string{"features_touch", "feature_variants_touch", "features_notify"}
+
+var tableReplacer *strings.Replacer
+
+// setupTables applies the table prefix, it must be called after flag.Parse.
+func setupTables() {
+	var oldnew []string
+	for _, name := range append(tableNames, triggerNames...) {
+		oldnew = append(oldnew, "{"+name+"}", tableName(name))
+	}
+	// not a name, the string literal of the notify channel
+	oldnew = append(oldnew, "{features_channel}", pq.QuoteLiteral(featuresChannel()))
+	tableReplacer = strings.NewReplacer(oldnew...)
+}
+
+// tableName returns the quoted table name with prefix.
+func tableName(name string) string {
+	return pq.QuoteIdentifier(*tablePrefix + name)
+}
+
+// tableSQL replaces {name} placeholders in query with the table names.
+func tableSQL(query string) string {
+	return tableReplacer.Replace(query)
+}
+
+// featuresChannel is the notify channel of the feature changes, prefixed like the tables.
+func featuresChannel() string {
+	return *tablePrefix + "features_changed"
+}